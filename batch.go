@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/oigeek/mirage-tank-images/miragetank"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pair is one cover/hidden/output triple processed in batch mode
+type pair struct {
+	cover, hidden, output string
+}
+
+// pairsFromDir pairs every <name>_a.<ext> in dir with the <name>_b.* next to it,
+// skipping images without a partner. The tank for each pair is written to outDir as <name>.png
+func pairsFromDir(dir, outDir string) ([]pair, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	covers := map[string]string{}
+	hiddens := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		switch {
+		case strings.HasSuffix(base, "_a"):
+			covers[strings.TrimSuffix(base, "_a")] = filepath.Join(dir, name)
+		case strings.HasSuffix(base, "_b"):
+			hiddens[strings.TrimSuffix(base, "_b")] = filepath.Join(dir, name)
+		}
+	}
+
+	var pairs []pair
+	for key, cover := range covers {
+		hidden, ok := hiddens[key]
+		if !ok {
+			logger.Warn("skipping unmatched cover", "file", cover, "missing", key+"_b")
+			continue
+		}
+		pairs = append(pairs, pair{cover: cover, hidden: hidden, output: filepath.Join(outDir, key+".png")})
+	}
+	for key, hidden := range hiddens {
+		if _, ok := covers[key]; !ok {
+			logger.Warn("skipping unmatched hidden image", "file", hidden, "missing", key+"_a")
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].output < pairs[j].output })
+	return pairs, nil
+}
+
+// imageExts are the extensions pairsInSequence treats as source images
+var imageExts = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".webp": true, ".bmp": true, ".tif": true, ".tiff": true,
+}
+
+// tankSuffix marks the tanks pairsInSequence writes, <cover>.tank.png, so they
+// never replace a PNG cover and are not taken for sources on the next run
+const tankSuffix = ".tank"
+
+// pairsInSequence sorts the images in dir by name and pairs them in order: the
+// first is the cover and the second the hidden image of the first tank, and so
+// on, e.g. for a folder of phone photos. The tank for each pair is written to
+// outDir as <cover>.tank.png; an odd image left over at the end is skipped, and
+// so are earlier tanks
+func pairsInSequence(dir, outDir string) ([]pair, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadDir 已经按文件名排好序
+	var images []string
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || !imageExts[strings.ToLower(ext)] {
+			continue
+		}
+		// -both 写出的是 <cover>.tank.gray.png 和 <cover>.tank.color.png
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, ext), ".gray"), ".color")
+		if strings.HasSuffix(base, tankSuffix) {
+			continue
+		}
+		images = append(images, name)
+	}
+
+	var pairs []pair
+	for i := 0; i+1 < len(images); i += 2 {
+		base := strings.TrimSuffix(images[i], filepath.Ext(images[i]))
+		pairs = append(pairs, pair{
+			cover:  filepath.Join(dir, images[i]),
+			hidden: filepath.Join(dir, images[i+1]),
+			output: filepath.Join(outDir, base+tankSuffix+".png"),
+		})
+	}
+	if len(images)%2 == 1 {
+		logger.Warn("skipping unpaired image", "file", filepath.Join(dir, images[len(images)-1]))
+	}
+	return pairs, nil
+}
+
+// outputsOf returns every file building p writes: its output, or with both
+// the grayscale and the color tank BuildBoth writes next to it
+func outputsOf(p pair, both bool) []string {
+	if p.output == miragetank.Stdio {
+		return nil
+	}
+	if both {
+		grayName, colorName := miragetank.BothNames(p.output)
+		return []string{grayName, colorName}
+	}
+	return []string{p.output}
+}
+
+// checkOutputs finds the pairs that would overwrite a file the batch still
+// needs: a source of any pair, or an output an earlier pair writes. It returns
+// the reason for every such pair, which must then not be built
+func checkOutputs(pairs []pair, both bool) map[pair]error {
+	// file 记下一个路径的绝对形式和文件信息，不存在的文件 info 为 nil
+	type file struct {
+		name, abs string
+		info      os.FileInfo
+	}
+	stat := func(name string) file {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			abs = name
+		}
+		f := file{name: name, abs: abs}
+		if info, err := os.Stat(abs); err == nil {
+			f.info = info
+		}
+		return f
+	}
+	same := func(a, b file) bool {
+		// 符号链接、硬链接指向同一个文件时路径不同
+		return a.abs == b.abs || (a.info != nil && b.info != nil && os.SameFile(a.info, b.info))
+	}
+
+	var sources []file
+	for _, p := range pairs {
+		for _, src := range []string{p.cover, p.hidden} {
+			if src != miragetank.Stdio {
+				sources = append(sources, stat(src))
+			}
+		}
+	}
+	conflicts := make(map[pair]error)
+	var written []file
+	for _, p := range pairs {
+		var outs []file
+		for _, name := range outputsOf(p, both) {
+			out := stat(name)
+			for _, src := range sources {
+				if conflicts[p] == nil && same(out, src) {
+					conflicts[p] = fmt.Errorf("output %s would overwrite the source %s", name, src.name)
+				}
+			}
+			for _, prev := range written {
+				if conflicts[p] == nil && same(out, prev) {
+					conflicts[p] = fmt.Errorf("output %s is already written by another pair", name)
+				}
+			}
+			outs = append(outs, out)
+		}
+		if conflicts[p] == nil {
+			written = append(written, outs...)
+		}
+	}
+	return conflicts
+}
+
+// pairsFromList reads cover,hidden,output rows from a CSV file
+func pairsFromList(name string) ([]pair, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+
+	var pairs []pair
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		pairs = append(pairs, pair{cover: record[0], hidden: record[1], output: record[2]})
+	}
+	return pairs, nil
+}
+
+// runBatch builds every pair using the given number of workers. A failing pair
+// does not stop the others; it is logged and counted in the summary.
+// runBatch returns the number of failed pairs
+func runBatch(pairs []pair, workers int, build func(p pair) error) int {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan pair)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				if err := build(p); err != nil {
+					mu.Lock()
+					failures++
+					logger.Error("build failed", "cover", p.cover, "hidden", p.hidden, "err", err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, p := range pairs {
+		jobs <- p
+	}
+	close(jobs)
+	wg.Wait()
+
+	logger.Info("batch finished", "succeeded", len(pairs)-failures, "failed", failures)
+	return failures
+}
+
+// result is the JSON line -json writes for each pair
+type result struct {
+	Cover     string `json:"cover"`
+	Hidden    string `json:"hidden"`
+	Output    string `json:"output,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// resultWriter writes one result line per pair, safe for concurrent use by the batch workers
+type resultWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// write records how building p went; size is zero when the build path does not report it
+func (w *resultWriter) write(p pair, size image.Point, elapsed time.Duration, err error) {
+	r := result{
+		Cover:     p.cover,
+		Hidden:    p.hidden,
+		Output:    p.output,
+		Width:     size.X,
+		Height:    size.Y,
+		ElapsedMS: elapsed.Milliseconds(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.enc.Encode(r); err != nil {
+		logger.Error("writing result failed", "err", err)
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/oigeek/mirage-tank-images
+
+go 1.26.0
+
+require (
+	github.com/HugoSmits86/nativewebp v1.3.0
+	golang.org/x/image v0.46.0
+)
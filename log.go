@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/oigeek/mirage-tank-images/miragetank"
+	"log/slog"
+	"os"
+)
+
+// logger receives the command's own diagnostic output, e.g. from batch mode
+// and the HTTP server
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// setLogger routes the command's and the miragetank package's log output to l
+func setLogger(l *slog.Logger) {
+	logger = l
+	miragetank.SetLogger(l)
+}
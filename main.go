@@ -1,228 +1,501 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"golang.org/x/image/draw"
+	"github.com/oigeek/mirage-tank-images/miragetank"
 	"image"
 	"image/color"
 	"image/png"
-	"log"
-	"net/http"
+	"log/slog"
+	"math"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 )
 
-// Desaturate converts an RGB image to a desaturated grayscale image
-func Desaturate(img image.Image) *image.Gray {
-	bounds := img.Bounds()
-	grayImg := image.NewGray(bounds)
+// compressionLevels maps the -compression flag values to PNG compression levels
+var compressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			maxVal := uint32(max(max(r, g), b)) >> 8
-			minVal := uint32(min(min(r, g), b)) >> 8
-			gray := uint8((maxVal + minVal) / 2)
-			grayImg.Set(x, y, color.Gray{Y: gray})
-		}
+// parseHexColor parses an opaque color written as #rrggbb or #rgb, with or without the #
+func parseHexColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
 	}
-	return grayImg
+	var c color.RGBA
+	if n, err := fmt.Sscanf(hex, "%02x%02x%02x", &c.R, &c.G, &c.B); err != nil || n != 3 || len(hex) != 6 {
+		return nil, fmt.Errorf("invalid color %q, want #rrggbb or #rgb", s)
+	}
+	c.A = 0xff
+	return c, nil
 }
 
-// AdjustLightness adjusts the lightness of a grayscale image
-func AdjustLightness(img *image.Gray, ratio float64) *image.Gray {
-	bounds := img.Bounds()
-	adjusted := image.NewGray(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			gray := img.GrayAt(x, y).Y
-			var newGray uint8
-			if ratio > 0 {
-				newGray = uint8(float64(gray)*(1-ratio) + 255*ratio)
-			} else {
-				newGray = uint8(float64(gray) * (1 + ratio))
-			}
-			adjusted.Set(x, y, color.Gray{Y: newGray})
-		}
-	}
-	return adjusted
+// resizeModes maps the -resize flag values to ResizeMode settings
+var resizeModes = map[string]miragetank.ResizeMode{
+	"stretch":   miragetank.Stretch,
+	"letterbox": miragetank.Letterbox,
+	"fit":       miragetank.Fit,
 }
 
-// Invert inverts the color of the grayscale image
-func Invert(img *image.Gray) *image.Gray {
-	bounds := img.Bounds()
-	inverted := image.NewGray(bounds)
+// grayMethods maps the -gray flag values to GrayMethod settings
+var grayMethods = map[string]miragetank.GrayMethod{
+	"lightness":  miragetank.Lightness,
+	"luminosity": miragetank.Luminosity,
+	"average":    miragetank.Average,
+	"linear":     miragetank.LinearLuminance,
+}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			gray := img.GrayAt(x, y).Y
-			inverted.Set(x, y, color.Gray{Y: 255 - gray})
-		}
+// ditherModes maps the -dither flag values to Dither settings
+var ditherModes = map[string]miragetank.Dither{
+	"none":  miragetank.NoDither,
+	"alpha": miragetank.DitherAlpha,
+	"all":   miragetank.DitherAll,
+}
+
+// extractFile writes the hidden image recovered from the tank at tankName to
+// targetName, encoded by extension like Build's output
+func extractFile(tankName, targetName string) error {
+	tank, err := miragetank.LoadImage(tankName)
+	if err != nil {
+		return err
 	}
-	return inverted
+	return (&miragetank.MirageTank{Format: miragetank.FormatFor(targetName)}).WriteFile(miragetank.ExtractHidden(tank), targetName)
 }
 
-// LinearDodgeBlend blends two grayscale images
-func LinearDodgeBlend(imgX, imgY *image.Gray) *image.Gray {
-	bounds := imgX.Bounds()
-	result := image.NewGray(bounds)
+// writeCompare writes Compare(tank) to targetName, encoded by extension like Build's output
+func writeCompare(tank image.Image, targetName string) error {
+	return (&miragetank.MirageTank{Format: miragetank.FormatFor(targetName)}).WriteFile(miragetank.Compare(tank), targetName)
+}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			grayX := imgX.GrayAt(x, y).Y
-			grayY := imgY.GrayAt(x, y).Y
-			newGray := uint8(clamp(int(grayX)+int(grayY), 0, 255))
-			result.Set(x, y, color.Gray{Y: newGray})
-		}
+// tunedRender is a RenderFunc that renders every pair with the ratios TuneRatios picks, see RenderTuned
+func tunedRender(m *miragetank.MirageTank, cover, hidden image.Image) (image.Image, error) {
+	tank, foreground, background, err := m.RenderTuned(context.Background(), cover, hidden)
+	if err != nil {
+		return nil, err
 	}
-	return result
+	logger.Info("tuned lightness ratios", "foreground", foreground, "background", background)
+	return tank, nil
 }
 
-// DivideBlend blends two grayscale images in 'divide' mode
-func DivideBlend(imgX, imgY *image.Gray) *image.Gray {
-	bounds := imgX.Bounds()
-	result := image.NewGray(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			grayX := imgX.GrayAt(x, y).Y
-			grayY := imgY.GrayAt(x, y).Y
-			var newGray uint8
-			if grayX == 0 {
-				newGray = 255
-			} else {
-				newGray = uint8(clamp(int(grayY)*255/int(grayX), 0, 255))
-			}
-			result.Set(x, y, color.Gray{Y: newGray})
+// budgetRender returns a RenderFunc that lowers m.Shrink until the encoded tank
+// takes at most budget bytes, see FitBytes. It keeps the encoded tank in *data
+// and returns it decoded, so the wrappers around it see what gets written
+func budgetRender(budget int, data *[]byte) miragetank.RenderFunc {
+	return func(m *miragetank.MirageTank, cover, hidden image.Image) (image.Image, error) {
+		shrink, encoded, err := m.FitBytes(context.Background(), cover, hidden, budget)
+		if err != nil {
+			return nil, err
 		}
+		logger.Info("fitted byte budget", "shrink", shrink, "bytes", len(encoded), "budget", budget)
+		*data = encoded
+		tank, _, err := image.Decode(bytes.NewReader(encoded))
+		return tank, err
 	}
-	return result
 }
 
-// AddMask adds an alpha channel to the grayscale image
-func AddMask(imgX, imgY *image.Gray) *image.NRGBA {
-	bounds := imgX.Bounds()
-	result := image.NewNRGBA(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			gray := imgX.GrayAt(x, y).Y
-			alpha := imgY.GrayAt(x, y).Y
-			result.Set(x, y, color.NRGBA{R: gray, G: gray, B: gray, A: alpha})
-		}
+// clampByte clamps a flag value meant as a gray or alpha level to 0-255
+func clampByte(v int) uint8 {
+	if v < 0 {
+		return 0
 	}
-	return result
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
 }
 
-// Build creates the 'mirage tank' image
-func Build(sourceX, sourceY, targetName string, shrink float64) {
-	fmt.Println("Start processing")
-	imgAFile, err := os.Open(sourceX)
-	if err != nil {
-		log.Fatal(err)
+// envOr returns the environment variable key, passed through format when it is
+// not nil, or fallback when the variable is empty
+func envOr(key, fallback string, format func(string) string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
 	}
-	defer imgAFile.Close()
-
-	imgBFile, err := os.Open(sourceY)
-	if err != nil {
-		log.Fatal(err)
+	if format != nil {
+		return format(v)
 	}
-	defer imgBFile.Close()
+	return v
+}
 
-	imgA, _, err := image.Decode(imgAFile)
-	if err != nil {
-		log.Fatal(err)
+// Main function
+func main() {
+	cover := flag.String("a", "", "cover image, http(s) URL or - for standard input, shown on a white background")
+	hidden := flag.String("b", "", "hidden image, http(s) URL or - for standard input, shown on a black background")
+	flag.StringVar(cover, "cover", "", "same as -a")
+	flag.StringVar(hidden, "hidden", "", "same as -b")
+	output := flag.String("o", "", "output path, .png or .webp, or - for standard output (PNG); the output directory in -dir mode")
+	shrink := flag.Float64("shrink", 1, "scale factor applied to the output size")
+	snap := flag.Int("snap", 1, "round the output width and height down to multiples of this, e.g. 16 for video encoders")
+	resizeMode := flag.String("resize", "stretch", "how a differently shaped -b is fitted: stretch, letterbox or fit (undistorted inside -a, padded with -pad)")
+	pad := flag.Int("pad", 128, "gray value (0-255) around the images placed by -resize fit; it shows up in the tank")
+	maxDim := flag.Int("maxDim", 0, "shrink the output so its longer side is at most this many pixels, overriding -shrink")
+	strength := flag.Float64("strength", 1, "divide step strength from 0 to 1; lower values tone down a blown-out hidden image")
+	extract := flag.String("extract", "", "recover the hidden image of this finished tank and write it to -o")
+	tile := flag.Int("tile", 0, "render and write PNG output in strips of this many rows to bound memory on huge images")
+	swap := flag.Bool("swap", false, "exchange -a and -b, hiding the cover and showing the hidden image on white")
+	autotune := flag.Bool("autotune", false, "search for the lightness ratios that separate the two images best")
+	maxBytes := flag.Int("maxBytes", 0, "lower -shrink until the encoded output is at most this many bytes, e.g. 5000000 for upload limits")
+	check := flag.Bool("check", false, "only decode and validate the inputs, without building or writing anything")
+	animate := flag.Bool("animate", false, "treat -b as an animated GIF and write an animated WebP to -o")
+	quality := flag.Int("quality", 0, "JPEG quality for .jpg/.jpeg output, which is flattened over white and loses the hidden image")
+	compression := flag.String("compression", "default", "PNG compression: default, none, speed or best")
+	both := flag.Bool("both", false, "write the grayscale and the color tank as <name>.gray.png and <name>.color.png for -o <name>.png")
+	exactColor := flag.Bool("exactColor", false, "with -both, solve the color tank's alpha so the cover shows exactly on white")
+	mask := flag.String("mask", "", "grayscale image scaling the lightness ratios per pixel: white applies them fully, black not at all")
+	measure := flag.Bool("measure", false, "log the PSNR and SSIM of the tank over white and over black against the sources")
+	debugDir := flag.String("debugDir", "", "write every intermediate layer of the pipeline into this directory as numbered PNGs")
+	leak := flag.String("leak", "", "also write the tank over the lightest gray on which the hidden image outweighs the cover to this path")
+	compare := flag.String("compare", "", "also write the tank on white and on black side by side to this path")
+	previewBg := flag.String("previewBg", "", "write the tank composited over this #rrggbb or #rgb background instead of the tank itself")
+	minAlpha := flag.Int("minAlpha", 0, "raise alpha values below this (0-255) so no pixel is fully transparent, keeping the look on white")
+	alphaBlur := flag.Float64("alphaBlur", 0, "blur only the alpha channel by this Gaussian radius in pixels to soften jagged edges, e.g. 0.7")
+	posterizeLevels := flag.Int("posterize", 0, "reduce both images to this many gray levels for a stylized tank, e.g. 4; 0 keeps every level")
+	edges := flag.Float64("edges", 0, "brighten the hidden image's edges by this Sobel strength, e.g. 0.5 for text and line art")
+	strict := flag.Bool("strict", false, "fail instead of warning when the two images are too similar to hide well")
+	grayMethod := flag.String("gray", "lightness", "how colors become gray: lightness, luminosity, average or linear (luminance in linear light)")
+	dither := flag.String("dither", "none", "ordered dither against banding in smooth gradients: none, alpha or all")
+	blendName := flag.String("blend", "", "blend mode combining the inverted cover with the hidden image, e.g. screen; default linearDodge")
+	divideName := flag.String("divide", "", "blend mode recovering the gray channel from -blend's result, e.g. colorDodge; default divide")
+	comment := flag.String("comment", "", "text comment embedded in PNG output; by default no metadata is written")
+	dir := flag.String("dir", "", "batch mode: build every <name>_a.*/<name>_b.* pair in this directory")
+	list := flag.String("list", "", "batch mode: build every cover,hidden,output row of this CSV file")
+	pairBy := flag.String("pairBy", "suffix", "how -dir pairs images: suffix matches <name>_a/<name>_b, sequence pairs them in name order")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of pairs built concurrently in batch mode")
+	serveHTTP := flag.Bool("serve", false, "run the HTTP server instead of building a single tank")
+	addr := flag.String("addr", envOr("PORT", ":8080", func(port string) string { return ":" + port }),
+		"listen address for -serve, defaults to :$PORT when PORT is set")
+	static := flag.String("static", envOr("STATIC_DIR", ".", nil),
+		"directory served by -serve, defaults to $STATIC_DIR when set")
+	maxUpload := flag.Int64("maxUpload", 16<<20, "largest /generate request body accepted by -serve, in bytes")
+	maxPixels := flag.Int("maxPixels", 50_000_000, "largest source or output pixel count accepted by -serve")
+	maxConcurrent := flag.Int("maxConcurrent", runtime.NumCPU(), "most /generate requests -serve renders at once; more get 429, 0 disables the limit")
+	drain := flag.Duration("drain", 30*time.Second, "how long -serve waits for in-flight requests after SIGTERM")
+	showProgress := flag.Bool("progress", false, "log the percentage done after every stage of a build")
+	verbose := flag.Bool("v", false, "log debug messages such as the start and end of every build and the time each stage took")
+	quiet := flag.Bool("quiet", false, "log nothing but errors")
+	logJSON := flag.Bool("logJSON", false, "write log messages to standard error as JSON lines instead of text")
+	jsonOut := flag.Bool("json", false, "write one JSON result line per pair to standard output; implies -quiet")
+	flag.Parse()
+
+	logOptions := &slog.HandlerOptions{Level: slog.LevelInfo}
+	switch {
+	case *quiet || *jsonOut:
+		logOptions.Level = slog.LevelError
+	case *verbose:
+		logOptions.Level = slog.LevelDebug
 	}
-
-	imgB, _, err := image.Decode(imgBFile)
-	if err != nil {
-		log.Fatal(err)
+	if *logJSON {
+		setLogger(slog.New(slog.NewJSONHandler(os.Stderr, logOptions)))
+	} else {
+		setLogger(slog.New(slog.NewTextHandler(os.Stderr, logOptions)))
 	}
-
-	width := int(float64(imgA.Bounds().Max.X) * shrink)
-	height := int(float64(imgA.Bounds().Max.Y) * shrink)
-
-	imgA = resize(imgA, width, height)
-	imgB = resize(imgB, width, height)
-
-	// 类型转换
-	grayImgA := Desaturate(imgA)
-	grayImgB := Desaturate(imgB)
-
-	imgA = Invert(AdjustLightness(grayImgA, 0.5))
-	imgB = AdjustLightness(grayImgB, -0.5)
-
-	// 将灰度图像转换为*image.Gray
-	linearDodge := LinearDodgeBlend(imgA.(*image.Gray), imgB.(*image.Gray))
-	divided := DivideBlend(linearDodge, imgB.(*image.Gray))
-
-	finalImage := AddMask(divided, linearDodge)
-
-	outputFile, err := os.Create(targetName)
-	if err != nil {
-		log.Fatal(err)
+	if *jsonOut && *output == miragetank.Stdio {
+		fmt.Fprintln(os.Stderr, "-json and -o - both write to standard output")
+		os.Exit(2)
 	}
-	defer outputFile.Close()
-
-	if err := png.Encode(outputFile, finalImage); err != nil {
-		log.Fatal(err)
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "err", err)
+		os.Exit(1)
 	}
 
-	fmt.Println("Finished")
-}
+	if *serveHTTP {
+		s := &server{addr: *addr, staticDir: *static, maxUpload: *maxUpload, maxPixels: *maxPixels,
+			drain: *drain, maxConcurrent: *maxConcurrent}
+		if err := s.serve(); err != nil {
+			fatal("启动服务器失败", err)
+		}
+		return
+	}
 
-// Resize resizes the image to the specified width and height.
-func resize(img image.Image, width, height int) image.Image {
-	newImg := image.NewRGBA(image.Rect(0, 0, width, height))
-	draw.CatmullRom.Scale(newImg, newImg.Bounds(), img, img.Bounds(), draw.Over, nil)
-	return newImg
-}
+	level, ok := compressionLevels[*compression]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid -compression %q, want default, none, speed or best\n", *compression)
+		os.Exit(2)
+	}
+	fitMode, ok := resizeModes[*resizeMode]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid -resize %q, want stretch, letterbox or fit\n", *resizeMode)
+		os.Exit(2)
+	}
+	method, ok := grayMethods[*grayMethod]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid -gray %q, want lightness, luminosity, average or linear\n", *grayMethod)
+		os.Exit(2)
+	}
+	ditherMode, ok := ditherModes[*dither]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid -dither %q, want none, alpha or all\n", *dither)
+		os.Exit(2)
+	}
+	var blends [2]miragetank.GrayBlend
+	for i, name := range []struct{ flag, value string }{{"blend", *blendName}, {"divide", *divideName}} {
+		if name.value == "" {
+			continue
+		}
+		var err error
+		if blends[i], err = miragetank.LookupBlend(name.value); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -%s %q, want one of %s\n", name.flag, name.value, strings.Join(miragetank.BlendNames(), ", "))
+			os.Exit(2)
+		}
+	}
+	if *maxBytes > 0 && *autotune {
+		fmt.Fprintln(os.Stderr, "-maxBytes and -autotune cannot be used together")
+		os.Exit(2)
+	}
+	// 分块渲染一次只有一个条带在内存里，需要整张图的选项都做不到
+	if *tile > 0 && (*autotune || *maxBytes > 0 || *measure || *both || *compare != "" || *leak != "" ||
+		*previewBg != "" || *debugDir != "" || *alphaBlur != 0 || *edges != 0 || *mask != "") {
+		fmt.Fprintln(os.Stderr, "-tile cannot be combined with -autotune, -maxBytes, -measure, -both, "+
+			"-compare, -leak, -previewBg, -debugDir, -alphaBlur, -edges or -mask, which need the whole image")
+		os.Exit(2)
+	}
+	// 动图按帧渲染后直接编码成 WebP，包装单张坦克的选项用不上
+	if *animate && (*tile > 0 || *autotune || *maxBytes > 0 || *measure || *both || *compare != "" || *leak != "" || *previewBg != "") {
+		fmt.Fprintln(os.Stderr, "-animate cannot be combined with -tile, -autotune, -maxBytes, -measure, -both, -compare, -leak or -previewBg")
+		os.Exit(2)
+	}
+	var background color.Color
+	if *previewBg != "" {
+		var err error
+		if background, err = parseHexColor(*previewBg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
 
-// Helper functions
-func max(a, b uint32) uint32 {
-	if a > b {
-		return a
+	var ratioMask image.Image
+	if *mask != "" {
+		var err error
+		if ratioMask, err = miragetank.LoadImage(*mask); err != nil {
+			fatal("reading mask failed", err)
+		}
 	}
-	return b
-}
 
-func min(a, b uint32) uint32 {
-	if a < b {
-		return a
+	if *debugDir != "" {
+		if err := os.MkdirAll(*debugDir, 0o755); err != nil {
+			fatal("creating debug directory failed", err)
+		}
 	}
-	return b
-}
 
-func clamp(value, min, max int) int {
-	if value < min {
-		return min
-	} else if value > max {
-		return max
+	if *extract != "" {
+		if *output == "" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := extractFile(*extract, *output); err != nil {
+			fatal("extract failed", err)
+		}
+		return
 	}
-	return value
-}
 
-// Main function
-func main() {
+	// buildPair returns the size of the tank it wrote, or zero when the build path does not report it
+	buildPair := func(p pair) (image.Point, error) {
+		if *swap {
+			p.cover, p.hidden = p.hidden, p.cover
+		}
+		if *check {
+			return image.Point{}, miragetank.Validate(p.cover, p.hidden)
+		}
+		m := miragetank.NewMirageTank()
+		m.Shrink = *shrink
+		m.MaxDim = *maxDim
+		m.Snap = *snap
+		m.DivideReduction = 1 - *strength
+		m.Comment = *comment
+		m.Compression = level
+		m.Resize = fitMode
+		m.Pad = clampByte(*pad)
+		m.GrayMethod = method
+		m.Dither = ditherMode
+		m.Blend, m.Divide = blends[0], blends[1]
+		m.StrictPair = *strict
+		m.EdgeEnhance = *edges
+		m.Posterize = *posterizeLevels
+		m.MinAlpha = clampByte(*minAlpha)
+		m.AlphaBlur = *alphaBlur
+		m.RatioMask = ratioMask
+		m.ExactColor = *exactColor
+		m.DebugDir = *debugDir
+		if *showProgress {
+			m.OnProgress = func(stage string, pct float64) {
+				logger.Info("progress", "output", p.output, "stage", stage, "pct", math.Round(pct))
+			}
+		}
+		m.Format = miragetank.FormatFor(p.output)
+		if miragetank.IsJPEGName(p.output) {
+			m.Format = miragetank.FlattenedJPEG
+			m.Quality = *quality
+		}
+		if *both {
+			return image.Point{}, m.BuildBoth(p.cover, p.hidden, p.output)
+		}
+		if *animate {
+			return image.Point{}, m.BuildAnimated(p.cover, p.hidden, p.output)
+		}
+		if *tile > 0 {
+			return image.Point{}, m.BuildTiled(p.cover, p.hidden, p.output, *tile)
+		}
+		render := (*miragetank.MirageTank).Render
+		if *autotune {
+			render = tunedRender
+		}
+		var fitted []byte
+		if *maxBytes > 0 {
+			render = budgetRender(*maxBytes, &fitted)
+		}
+		if *measure {
+			tankRender := render
+			render = func(m *miragetank.MirageTank, a, b image.Image) (image.Image, error) {
+				tank, err := tankRender(m, a, b)
+				if err != nil {
+					return nil, err
+				}
+				q, err := m.Measure(a, b, tank)
+				if err != nil {
+					return nil, err
+				}
+				logger.Info("tank quality", "cover", p.cover,
+					"coverPSNR", q.CoverPSNR, "coverSSIM", q.CoverSSIM,
+					"hiddenPSNR", q.HiddenPSNR, "hiddenSSIM", q.HiddenSSIM)
+				return tank, nil
+			}
+		}
+		if *compare != "" {
+			tankRender := render
+			render = func(m *miragetank.MirageTank, a, b image.Image) (image.Image, error) {
+				tank, err := tankRender(m, a, b)
+				if err != nil {
+					return nil, err
+				}
+				return tank, writeCompare(tank, *compare)
+			}
+		}
+		if *leak != "" {
+			tankRender := render
+			render = func(m *miragetank.MirageTank, a, b image.Image) (image.Image, error) {
+				tank, err := tankRender(m, a, b)
+				if err != nil {
+					return nil, err
+				}
+				gray, composite := miragetank.LeakBackground(tank)
+				logger.Info("found leak background", "gray", gray)
+				return tank, (&miragetank.MirageTank{Format: miragetank.FormatFor(*leak)}).WriteFile(composite, *leak)
+			}
+		}
+		if background != nil {
+			// 预览模式：输出叠在指定背景色上的效果，而不是坦克本身
+			tankRender := render
+			render = func(m *miragetank.MirageTank, a, b image.Image) (image.Image, error) {
+				tank, err := tankRender(m, a, b)
+				if err != nil {
+					return nil, err
+				}
+				return miragetank.CompositeOver(tank, background), nil
+			}
+		}
+		var size image.Point
+		sized := func(m *miragetank.MirageTank, a, b image.Image) (image.Image, error) {
+			tank, err := render(m, a, b)
+			if err == nil {
+				size = tank.Bounds().Size()
+			}
+			return tank, err
+		}
+		if *maxBytes > 0 && background == nil {
+			// FitBytes 已经编码好了坦克，直接写出，不再渲染和编码第二遍
+			a, err := miragetank.LoadImage(p.cover)
+			if err != nil {
+				return size, err
+			}
+			b, err := miragetank.LoadImage(p.hidden)
+			if err != nil {
+				return size, err
+			}
+			if _, err := sized(m, a, b); err != nil {
+				return size, err
+			}
+			return size, miragetank.WriteBytes(fitted, p.output)
+		}
+		return size, miragetank.BuildFile(m, sized, p.cover, p.hidden, p.output)
+	}
 
-	Build("cmd20-mirage-tank-images/1724382048281.png",
-		"cmd20-mirage-tank-images/1726296462076.png",
-		"cmd20-mirage-tank-images/target_image.png", 1)
-}
-func main1() {
-	//println(time.Now().Add(time.Hour * 120).Unix())
-	//return
+	results := &resultWriter{enc: json.NewEncoder(os.Stdout)}
+	var conflicts map[pair]error
+	build := func(p pair) error {
+		start := time.Now()
+		err := conflicts[p]
+		var size image.Point
+		if err == nil {
+			size, err = buildPair(p)
+		}
+		if *jsonOut {
+			results.write(p, size, time.Since(start), err)
+		}
+		return err
+	}
 
-	// 设置静态文件目录
-	staticDir := "/Users/bytedance/GolandProjects/awesomeProject/cmd20-mirage-tank-images" // 替换为你的静态文件目录
+	if *dir != "" || *list != "" {
+		if *compare != "" || *leak != "" || *debugDir != "" {
+			fmt.Fprintln(os.Stderr, "-compare, -leak and -debugDir write single files and cannot be used with -dir or -list")
+			os.Exit(2)
+		}
+		var pairs []pair
+		var err error
+		if *dir != "" {
+			outDir := *output
+			if outDir == "" {
+				outDir = *dir
+			}
+			switch *pairBy {
+			case "suffix":
+				pairs, err = pairsFromDir(*dir, outDir)
+			case "sequence":
+				pairs, err = pairsInSequence(*dir, outDir)
+			default:
+				err = fmt.Errorf("invalid -pairBy %q, want suffix or sequence", *pairBy)
+			}
+		} else {
+			pairs, err = pairsFromList(*list)
+		}
+		if err != nil {
+			fatal("reading batch input failed", err)
+		}
+		// 在启动 worker 之前建好输出目录，否则每一对都会各自报一次同样的错
+		if *dir != "" && *output != "" {
+			if err := os.MkdirAll(*output, 0o755); err != nil {
+				fatal("creating output directory failed", err)
+			}
+		}
+		conflicts = checkOutputs(pairs, *both)
+		if runBatch(pairs, *workers, build) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-	// 创建一个新的 HTTP 处理器
-	http.Handle("/", http.FileServer(http.Dir(staticDir)))
+	if *cover == "" || *hidden == "" || (*output == "" && !*check) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// 标准输入只能读一次，两张源图不能都来自管道
+	if *cover == miragetank.Stdio && *hidden == miragetank.Stdio {
+		fmt.Fprintln(os.Stderr, "only one of -a and -b can be - (standard input)")
+		os.Exit(2)
+	}
 
-	// 监听端口 8080
-	fmt.Println("服务器已启动，访问 http://localhost:8080")
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil {
-		fmt.Println("启动服务器失败:", err)
+	p := pair{cover: *cover, hidden: *hidden, output: *output}
+	conflicts = checkOutputs([]pair{p}, *both)
+	if err := build(p); err != nil {
+		fatal("build failed", err)
 	}
 }
@@ -0,0 +1,172 @@
+package miragetank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HugoSmits86/nativewebp"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// BuildAnimated creates an animated 'mirage tank': every frame of the animated
+// GIF hidden is hidden behind the still image cover, and the frames are
+// written to targetName as an animated WebP with the GIF's delays and loop count.
+// An animated cover only contributes its first frame
+func BuildAnimated(cover, hidden, targetName string, shrink float64) error {
+	m := NewMirageTank()
+	m.Shrink = shrink
+	return m.BuildAnimated(cover, hidden, targetName)
+}
+
+// BuildAnimated is the package-level BuildAnimated rendering every frame with
+// m's settings, see RenderFrames
+func (m *MirageTank) BuildAnimated(cover, hidden, targetName string) error {
+	if FormatFor(targetName) != WebP {
+		return fmt.Errorf("%s: animated tanks can only be written as .webp", targetName)
+	}
+
+	logger.Debug("start processing", "cover", cover, "hidden", hidden, "output", targetName)
+	coverFile, err := openSource(context.Background(), cover)
+	if err != nil {
+		return err
+	}
+	defer coverFile.Close()
+	coverImg, format, err := decodeImage(coverFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecodeCover, err)
+	}
+	logger.Debug("read cover", "format", format, "size", coverImg.Bounds().Size())
+
+	hiddenFile, err := openSource(context.Background(), hidden)
+	if err != nil {
+		return err
+	}
+	defer hiddenFile.Close()
+	g, err := gif.DecodeAll(hiddenFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecodeHidden, err)
+	}
+	logger.Debug("read hidden image", "format", "gif", "frames", len(g.Image))
+
+	frames, err := m.RenderFrames(context.Background(), coverImg, g)
+	if err != nil {
+		return err
+	}
+
+	out, err := createOutput(targetName)
+	if err != nil {
+		return err
+	}
+	if err := EncodeAnimatedWebP(out, frames, g.Delay, g.LoopCount); err != nil {
+		out.Abort()
+		return fmt.Errorf("encode %s: %w", targetName, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	logger.Debug("finished", "output", targetName)
+	return nil
+}
+
+// RenderFrames renders one tank per frame of g, each hiding the fully composited
+// GIF frame behind cover. m.Progress and m.OnProgress, if set, are called once
+// per finished frame
+func (m *MirageTank) RenderFrames(ctx context.Context, cover image.Image, g *gif.GIF) ([]image.Image, error) {
+	hidden, err := gifFrames(g)
+	if err != nil {
+		return nil, err
+	}
+
+	// 只拿第一帧检查一次表图和里图是否太像，不必每帧都检查
+	if err := m.checkPair(ctx, cover, hidden[0]); err != nil {
+		return nil, err
+	}
+	// 单帧的进度没有意义，改为按完成的帧数汇报
+	frameTank := *m
+	frameTank.Progress, frameTank.OnProgress = nil, nil
+	frameTank.pairChecked = true
+
+	frames := make([]image.Image, len(hidden))
+	for i, frame := range hidden {
+		frames[i], err = frameTank.RenderContext(ctx, cover, frame)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		m.report(StageFrame, float64(i+1)/float64(len(hidden)))
+	}
+	return frames, nil
+}
+
+// gifFrames composites the frames of g onto its logical screen, applying each
+// frame's disposal method, so every returned image is the full picture a GIF
+// viewer shows at that point. Frames may be smaller than the screen and offset
+// inside it; the screen starts out transparent
+func gifFrames(g *gif.GIF) ([]image.Image, error) {
+	if len(g.Image) == 0 {
+		return nil, errors.New("gif has no frames")
+	}
+
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if screen.Empty() {
+		// 没有逻辑屏幕尺寸时，用所有帧的并集
+		for _, frame := range g.Image {
+			screen = screen.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewRGBA(screen)
+	frames := make([]image.Image, len(g.Image))
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(screen)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		snapshot := image.NewRGBA(screen)
+		copy(snapshot.Pix, canvas.Pix)
+		frames[i] = snapshot
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, nil
+}
+
+// EncodeAnimatedWebP writes frames to w as a lossless animated WebP.
+// delays are in hundredths of a second and loopCount follows image/gif:
+// 0 loops forever, -1 plays once and n plays n+1 times
+func EncodeAnimatedWebP(w io.Writer, frames []image.Image, delays []int, loopCount int) error {
+	ani := &nativewebp.Animation{
+		Images:    frames,
+		Durations: make([]uint, len(frames)),
+		Disposals: make([]uint, len(frames)),
+	}
+	for i := range frames {
+		if i < len(delays) && delays[i] > 0 {
+			ani.Durations[i] = uint(delays[i]) * 10
+		}
+		// 每帧显示后清空为透明背景，避免半透明的坦克像素和上一帧叠加
+		ani.Disposals[i] = 1
+	}
+	switch {
+	case loopCount < 0:
+		ani.LoopCount = 1
+	case loopCount > 0:
+		ani.LoopCount = uint16(clamp(loopCount+1, 1, 1<<16-1))
+	}
+	return nativewebp.EncodeAll(w, ani, nil)
+}
@@ -0,0 +1,78 @@
+package miragetank
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchWidth and benchHeight are the size of the images the benchmarks run on
+const (
+	benchWidth  = 1024
+	benchHeight = 768
+)
+
+// benchImage returns a benchWidth x benchHeight color gradient, shifted by seed
+// so two calls give different images
+func benchImage(seed int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, benchWidth, benchHeight))
+	for y := 0; y < benchHeight; y++ {
+		for x := 0; x < benchWidth; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x + seed), uint8(y + 2*seed), uint8(x ^ y), 255})
+		}
+	}
+	return img
+}
+
+func BenchmarkDesaturate(b *testing.B) {
+	img := benchImage(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Desaturate(img)
+	}
+}
+
+func BenchmarkLinearDodgeBlend(b *testing.B) {
+	x, y := Desaturate(benchImage(0)), Desaturate(benchImage(64))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		LinearDodgeBlend(x, y)
+	}
+}
+
+func BenchmarkDivideBlend(b *testing.B) {
+	x, y := Desaturate(benchImage(0)), Desaturate(benchImage(64))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DivideBlend(x, y)
+	}
+}
+
+func BenchmarkBuild(b *testing.B) {
+	dir := b.TempDir()
+	cover, hidden := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	for name, img := range map[string]image.Image{cover: benchImage(0), hidden: benchImage(64)} {
+		f, err := os.Create(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+	out := filepath.Join(dir, "tank.png")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Build(cover, hidden, out, 1, DefaultForegroundRatio, DefaultBackgroundRatio, Stretch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package miragetank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"sync"
+)
+
+// BlendFunc blends one pixel x of the first image with the pixel y at the same
+// place in the second
+type BlendFunc func(x, y uint8) uint8
+
+// Gray turns f into a GrayBlend that applies it to every pair of pixels the two
+// images share, e.g. for MirageTank.Blend
+func (f BlendFunc) Gray() GrayBlend {
+	return func(imgX, imgY *image.Gray) *image.Gray { return blendPixels(imgX, imgY, f) }
+}
+
+// errUnknownBlend is returned by LookupBlend for names nothing was registered under
+var errUnknownBlend = errors.New("unknown blend mode")
+
+// blendRegistry holds the blend modes LookupBlend finds by name, guarded by blendMu
+var (
+	blendMu       sync.RWMutex
+	blendRegistry = map[string]BlendFunc{
+		"linearDodge": linearDodgePixel,
+		"divide":      dividePixel,
+		"multiply":    multiplyPixel,
+		"screen":      screenPixel,
+		"overlay":     overlayPixel,
+		"subtract":    subtractPixel,
+		"difference":  differencePixel,
+		"darken":      darkenPixel,
+		"lighten":     lightenPixel,
+		"colorDodge":  colorDodgePixel,
+		"colorBurn":   colorBurnPixel,
+	}
+)
+
+// RegisterBlend makes fn available to LookupBlend under name, replacing what
+// was registered under name before, built-in modes included. It panics if fn is nil
+func RegisterBlend(name string, fn BlendFunc) {
+	if fn == nil {
+		panic("miragetank: RegisterBlend of nil BlendFunc " + name)
+	}
+	blendMu.Lock()
+	defer blendMu.Unlock()
+	blendRegistry[name] = fn
+}
+
+// LookupBlend returns the blend mode registered under name as a GrayBlend
+func LookupBlend(name string) (GrayBlend, error) {
+	blendMu.RLock()
+	fn, ok := blendRegistry[name]
+	blendMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownBlend, name)
+	}
+	return fn.Gray(), nil
+}
+
+// BlendNames returns the names of the registered blend modes in sorted order
+func BlendNames() []string {
+	blendMu.RLock()
+	defer blendMu.RUnlock()
+	names := make([]string, 0, len(blendRegistry))
+	for name := range blendRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MultiplyBlend blends two grayscale images in 'multiply' mode, x*y/255
+func MultiplyBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, multiplyPixel)
+}
+
+// multiplyPixel is the per-pixel function of MultiplyBlend
+func multiplyPixel(x, y uint8) uint8 {
+	return uint8(clamp((int(x)*int(y)+127)/255, 0, 255))
+}
+
+// ScreenBlend blends two grayscale images in 'screen' mode, 255-(255-x)*(255-y)/255
+func ScreenBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, screenPixel)
+}
+
+// screenPixel is the per-pixel function of ScreenBlend
+func screenPixel(x, y uint8) uint8 {
+	return uint8(clamp(255-((255-int(x))*(255-int(y))+127)/255, 0, 255))
+}
+
+// OverlayBlend blends two grayscale images in 'overlay' mode, using imgX as the base:
+// multiply where the base is below 128 and screen otherwise, both at double strength
+func OverlayBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, overlayPixel)
+}
+
+// overlayPixel is the per-pixel function of OverlayBlend
+func overlayPixel(x, y uint8) uint8 {
+	if x < 128 {
+		return uint8(clamp((2*int(x)*int(y)+127)/255, 0, 255))
+	}
+	return uint8(clamp(255-(2*(255-int(x))*(255-int(y))+127)/255, 0, 255))
+}
+
+// SubtractBlend blends two grayscale images in 'subtract' mode, x-y clamped at 0
+func SubtractBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, subtractPixel)
+}
+
+// subtractPixel is the per-pixel function of SubtractBlend
+func subtractPixel(x, y uint8) uint8 {
+	return uint8(clamp(int(x)-int(y), 0, 255))
+}
+
+// DifferenceBlend blends two grayscale images in 'difference' mode, |x-y|
+func DifferenceBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, differencePixel)
+}
+
+// differencePixel is the per-pixel function of DifferenceBlend
+func differencePixel(x, y uint8) uint8 {
+	if x < y {
+		return y - x
+	}
+	return x - y
+}
+
+// DarkenBlend blends two grayscale images in 'darken' mode, keeping the darker pixel
+func DarkenBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, darkenPixel)
+}
+
+// darkenPixel is the per-pixel function of DarkenBlend
+func darkenPixel(x, y uint8) uint8 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// LightenBlend blends two grayscale images in 'lighten' mode, keeping the lighter pixel
+func LightenBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, lightenPixel)
+}
+
+// lightenPixel is the per-pixel function of LightenBlend
+func lightenPixel(x, y uint8) uint8 {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+// ColorDodgeBlend blends two grayscale images in 'color dodge' mode, using imgX
+// as the base: x*255/(255-y) clamped at 255. A black base stays black and
+// otherwise a white y gives white, where the division is undefined
+func ColorDodgeBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, colorDodgePixel)
+}
+
+// colorDodgePixel is the per-pixel function of ColorDodgeBlend
+func colorDodgePixel(x, y uint8) uint8 {
+	switch {
+	case x == 0:
+		return 0
+	case y == 255:
+		return 255
+	}
+	d := 255 - int(y)
+	return uint8(clamp((int(x)*255+d/2)/d, 0, 255))
+}
+
+// ColorBurnBlend blends two grayscale images in 'color burn' mode, using imgX
+// as the base: 255-(255-x)*255/y clamped at 0. A white base stays white and
+// otherwise a black y gives black, where the division is undefined
+func ColorBurnBlend(imgX, imgY *image.Gray) *image.Gray {
+	return blendPixels(imgX, imgY, colorBurnPixel)
+}
+
+// colorBurnPixel is the per-pixel function of ColorBurnBlend
+func colorBurnPixel(x, y uint8) uint8 {
+	switch {
+	case x == 255:
+		return 255
+	case y == 0:
+		return 0
+	}
+	return uint8(clamp(255-((255-int(x))*255+int(y)/2)/int(y), 0, 255))
+}
+
+// MixBlend returns the weighted average t*x + (1-t)*y of two grayscale images,
+// with t clamped to [0, 1]
+func MixBlend(imgX, imgY *image.Gray, t float64) *image.Gray {
+	return mixBlend(context.Background(), imgX, imgY, t)
+}
+
+// mixBlend implements MixBlend, giving up early once ctx is done
+func mixBlend(ctx context.Context, imgX, imgY *image.Gray, t float64) *image.Gray {
+	t = math.Max(0, math.Min(1, t))
+	return blendPixelsContext(ctx, imgX, imgY, func(x, y uint8) uint8 {
+		return uint8(clamp(int(t*float64(x)+(1-t)*float64(y)+0.5), 0, 255))
+	})
+}
+
+// blendPixels applies fn to every pair of pixels the two images share
+func blendPixels(imgX, imgY *image.Gray, fn func(x, y uint8) uint8) *image.Gray {
+	return blendPixelsContext(context.Background(), imgX, imgY, fn)
+}
+
+// blendPixelsContext is blendPixels, giving up early once ctx is done
+func blendPixelsContext(ctx context.Context, imgX, imgY *image.Gray, fn func(x, y uint8) uint8) *image.Gray {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	result := image.NewGray(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+			rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < size.Dx(); x++ {
+				out[x] = fn(rowX[x], rowY[x])
+			}
+		}
+	})
+	return result
+}
@@ -0,0 +1,90 @@
+package miragetank
+
+import (
+	"image"
+	"testing"
+)
+
+// pixelCase is one x, y input pair of a blend and the pixel it must produce
+type pixelCase struct {
+	x, y, want uint8
+}
+
+// checkBlend runs blend on 1x1 images for every case
+func checkBlend(t *testing.T, name string, blend func(imgX, imgY *image.Gray) *image.Gray, cases []pixelCase) {
+	t.Helper()
+	for _, c := range cases {
+		imgX, imgY := image.NewGray(image.Rect(0, 0, 1, 1)), image.NewGray(image.Rect(0, 0, 1, 1))
+		imgX.Pix[0], imgY.Pix[0] = c.x, c.y
+		if got := blend(imgX, imgY).Pix[0]; got != c.want {
+			t.Errorf("%s(%d, %d) = %d, want %d", name, c.x, c.y, got, c.want)
+		}
+	}
+}
+
+func TestScreenBlend(t *testing.T) {
+	checkBlend(t, "ScreenBlend", ScreenBlend, []pixelCase{
+		{0, 0, 0},
+		{0, 255, 255},
+		{255, 0, 255},
+		{255, 255, 255},
+		{0, 128, 128},
+		// 255-127*127/255 = 191.75
+		{128, 128, 192},
+	})
+}
+
+func TestSubtractDifferenceBlend(t *testing.T) {
+	checkBlend(t, "SubtractBlend", SubtractBlend, []pixelCase{
+		{0, 0, 0},
+		{255, 0, 255},
+		{0, 255, 0},
+		{255, 255, 0},
+		{200, 50, 150},
+		{50, 200, 0},
+	})
+	checkBlend(t, "DifferenceBlend", DifferenceBlend, []pixelCase{
+		{0, 0, 0},
+		{255, 0, 255},
+		{0, 255, 255},
+		{255, 255, 0},
+		{200, 50, 150},
+		{50, 200, 150},
+	})
+}
+
+func TestDarkenLightenBlend(t *testing.T) {
+	checkBlend(t, "DarkenBlend", DarkenBlend, []pixelCase{
+		{0, 255, 0},
+		{255, 0, 0},
+		{255, 255, 255},
+		{90, 30, 30},
+	})
+	checkBlend(t, "LightenBlend", LightenBlend, []pixelCase{
+		{0, 255, 255},
+		{255, 0, 255},
+		{0, 0, 0},
+		{90, 30, 90},
+	})
+}
+
+func TestColorDodgeBurnBlend(t *testing.T) {
+	checkBlend(t, "ColorDodgeBlend", ColorDodgeBlend, []pixelCase{
+		{0, 255, 0},
+		{0, 0, 0},
+		{1, 255, 255},
+		{255, 0, 255},
+		{100, 0, 100},
+		// 100*255/(255-128) = 200.8
+		{100, 128, 201},
+	})
+	checkBlend(t, "ColorBurnBlend", ColorBurnBlend, []pixelCase{
+		{255, 0, 255},
+		{255, 255, 255},
+		{254, 0, 0},
+		{0, 255, 0},
+		{100, 255, 100},
+		// 255-155*255/200 = 57.375
+		{100, 200, 57},
+	})
+}
@@ -0,0 +1,96 @@
+package miragetank
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+)
+
+// errOverBudget is returned by FitBytes when even a 1 pixel wide tank is too large
+var errOverBudget = errors.New("no shrink fits the byte budget")
+
+// FitBytes finds the largest shrink, at most m.Shrink, at which the tank of
+// cover and hidden encodes to at most budget bytes in m.Format, and returns it
+// together with the encoded tank. It binary searches the canvas width, so it
+// assumes a smaller tank never encodes larger; each canvas size is rendered and
+// encoded at most once, even when Snap maps several widths onto it. MaxDim is
+// ignored. m.Progress and m.OnProgress, if set, are called after every size it
+// tries, as StageFit, and with 1 once it has found one
+func (m *MirageTank) FitBytes(ctx context.Context, cover, hidden image.Image, budget int) (shrink float64, data []byte, err error) {
+	if err := checkSources(cover, hidden); err != nil {
+		return 0, nil, err
+	}
+
+	// 源图片只检查一次，不必每个候选尺寸都检查
+	if err := m.checkPair(ctx, cover, hidden); err != nil {
+		return 0, nil, err
+	}
+	sized := *m
+	sized.pairChecked = true
+	sized.MaxDim = 0
+	sized.Progress, sized.OnProgress = nil, nil
+	sized.DebugDir = ""
+	sized.Shrink = 1
+	full, _ := sized.canvas(cover.Bounds(), hidden.Bounds())
+
+	// 先试 m.Shrink，再二分查找最多 bits.Len(hi) 次，按尝试的次数汇报进度
+	hi := int(float64(full) * m.Shrink)
+	tries, maxTries := 0, 1+bits.Len(uint(hi))
+	cache := make(map[image.Point][]byte)
+	encode := func(shrink float64) ([]byte, error) {
+		tries++
+		m.report(StageFit, float64(tries)/float64(maxTries+1))
+		sized.Shrink = shrink
+		width, height := sized.canvas(cover.Bounds(), hidden.Bounds())
+		key := image.Pt(width, height)
+		if data, ok := cache[key]; ok {
+			return data, nil
+		}
+		tank, err := sized.RenderContext(ctx, cover, hidden)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := sized.Encode(&buf, tank); err != nil {
+			return nil, err
+		}
+		cache[key] = buf.Bytes()
+		return buf.Bytes(), nil
+	}
+	// 多加半个像素，避免浮点误差让画布宽度少 1
+	shrinkFor := func(width int) float64 {
+		return (float64(width) + 0.5) / float64(full)
+	}
+
+	data, err = encode(m.Shrink)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) <= budget {
+		m.report(StageFit, 1)
+		return m.Shrink, data, nil
+	}
+
+	// lo 宽度能放进预算（0 表示还没找到），hi 宽度放不进
+	lo := 0
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		encoded, err := encode(shrinkFor(mid))
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(encoded) <= budget {
+			lo, data = mid, encoded
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return 0, nil, fmt.Errorf("%w: %d bytes", errOverBudget, budget)
+	}
+	m.report(StageFit, 1)
+	return shrinkFor(lo), data, nil
+}
@@ -0,0 +1,257 @@
+package miragetank
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// RenderColor is the colored counterpart of Render. It runs the lightness,
+// blend and divide steps on the red, green and blue channels separately,
+// so cover keeps its colors on a white background and hidden keeps its colors on a black one.
+// The three per-channel alphas are averaged into the single alpha an image can
+// carry, which is why the cover is only approximated where its channels differ a
+// lot; MirageTank.ExactColor solves for the alpha instead and keeps the cover exact
+func (m *MirageTank) RenderColor(cover, hidden image.Image) (image.Image, error) {
+	return m.RenderColorContext(context.Background(), cover, hidden)
+}
+
+// RenderColorContext is RenderColor that gives up with ctx.Err() soon after
+// ctx is done, like RenderContext
+func (m *MirageTank) RenderColorContext(ctx context.Context, cover, hidden image.Image) (image.Image, error) {
+	if err := checkSources(cover, hidden); err != nil {
+		return nil, err
+	}
+	if err := m.checkPair(ctx, cover, hidden); err != nil {
+		return nil, err
+	}
+	imgA, imgB := m.fit(cover, hidden)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tank, err := m.renderColorFitted(ctx, imgA, imgB)
+	if err != nil {
+		return nil, err
+	}
+	return m.colorModel(ctx, tank), nil
+}
+
+// renderColorFitted is renderFitted for RenderColor
+func (m *MirageTank) renderColorFitted(ctx context.Context, imgA, imgB image.Image) (image.Image, error) {
+	if imgA.Bounds().Size() != imgB.Bounds().Size() {
+		return nil, fmt.Errorf("%w: %v vs %v", ErrBoundsMismatch, imgA.Bounds(), imgB.Bounds())
+	}
+
+	channelsA, channelsB := splitChannels(ctx, imgA), splitChannels(ctx, imgB)
+	for c := range channelsA {
+		channelsA[c], channelsB[c] = m.sharpen(ctx, channelsA[c]), m.sharpen(ctx, channelsB[c])
+	}
+	m.progressDefault(StageDesaturate)
+	if m.AutoContrast {
+		// 每个通道单独拉伸，和常见的"自动色阶"一致
+		for c := range channelsB {
+			channelsB[c] = autoContrast(ctx, channelsB[c], m.ClipLowPct, m.ClipHighPct)
+		}
+	}
+	if m.EdgeEnhance != 0 {
+		for c := range channelsB {
+			channelsB[c] = edgeEnhance(ctx, channelsB[c], m.EdgeEnhance)
+		}
+	}
+	if m.Posterize >= 2 {
+		for c := range channelsA {
+			channelsA[c], channelsB[c] = posterize(ctx, channelsA[c], m.Posterize), posterize(ctx, channelsB[c], m.Posterize)
+		}
+	}
+	m.progressDefault(StageEnhance)
+	useGamma := m.Gamma != 0 && m.Gamma != 1
+	mask := m.ratioMask(channelsA[0].Bounds())
+	if m.ExactColor {
+		return m.renderExactColor(ctx, channelsA, channelsB, mask, useGamma)
+	}
+	blend, divide := m.blends(ctx)
+
+	var hidden, alphas [3]*image.Gray
+	for c := range channelsA {
+		cover := invert(ctx, adjustLightnessMasked(ctx, channelsA[c], m.ForegroundRatio, mask))
+		hidden[c] = adjustLightnessMasked(ctx, channelsB[c], m.BackgroundRatio, mask)
+		if useGamma {
+			cover, hidden[c] = gamma(ctx, cover, m.Gamma), gamma(ctx, hidden[c], m.Gamma)
+		}
+		alphas[c] = blend(cover, hidden[c])
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// 每个通道在同一个循环里完成调整明暗、反相和混合，循环结束后一起汇报
+	m.progressDefault(StageLightness)
+	m.progressDefault(StageInvert)
+
+	// 三个通道共用一个 alpha，取平均值
+	alpha := averageGray(ctx, alphas[0], alphas[1], alphas[2])
+
+	var rgb [3]*image.Gray
+	for c := range hidden {
+		rgb[c] = divide(alpha, hidden[c])
+		if t := m.divideStrength(); t != 1 {
+			rgb[c] = mixBlend(ctx, rgb[c], alpha, t)
+		}
+		if useGamma {
+			rgb[c] = gamma(ctx, rgb[c], 1/m.Gamma)
+		}
+	}
+	m.progressDefault(StageBlend)
+
+	result := m.finish(ctx, addColorMask(ctx, rgb[0], rgb[1], rgb[2], alpha))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.progressDefault(StageMask)
+	return result, nil
+}
+
+// renderExactColor finishes renderColorFitted for m.ExactColor, solving every
+// pixel's color and alpha with solveColor instead of running the gray blends
+func (m *MirageTank) renderExactColor(ctx context.Context, channelsA, channelsB [3]*image.Gray, mask *image.Gray, useGamma bool) (image.Image, error) {
+	var cover, hidden [3]*image.Gray
+	for c := range channelsA {
+		cover[c] = adjustLightnessMasked(ctx, channelsA[c], m.ForegroundRatio, mask)
+		hidden[c] = adjustLightnessMasked(ctx, channelsB[c], m.BackgroundRatio, mask)
+		if useGamma {
+			cover[c], hidden[c] = gamma(ctx, cover[c], m.Gamma), gamma(ctx, hidden[c], m.Gamma)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// 直接求解颜色和 alpha，没有反相步骤
+	m.progressDefault(StageLightness)
+
+	rgb, alpha := solveColor(ctx, cover, hidden)
+	if useGamma {
+		for c := range rgb {
+			rgb[c] = gamma(ctx, rgb[c], 1/m.Gamma)
+		}
+	}
+	m.progressDefault(StageBlend)
+
+	result := m.finish(ctx, addColorMask(ctx, rgb[0], rgb[1], rgb[2], alpha))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.progressDefault(StageMask)
+	return result, nil
+}
+
+// solveColor returns the color channels and the alpha of the tank that shows
+// cover exactly over white and comes as close to hidden over black as a single
+// alpha allows. Over white a pixel shows a*c + 255*(1-a) and over black a*c, so
+// each channel would like a = 1 - (cover-hidden)/255. One alpha has to serve
+// all three, so it takes their mean, which minimizes the squared error on black,
+// raised where needed so that no channel of c has to go below 0 to keep the
+// cover exact. Where the channels of cover-hidden differ a lot, for example a
+// red cover over a green hidden image, the hidden image's colors shift
+func solveColor(ctx context.Context, cover, hidden [3]*image.Gray) (rgb [3]*image.Gray, alpha *image.Gray) {
+	size := cover[0].Bounds()
+	for c := range cover {
+		size = overlap(overlap(size, cover[c].Bounds()), hidden[c].Bounds())
+	}
+	for c := range rgb {
+		rgb[c] = image.NewGray(size)
+	}
+	alpha = image.NewGray(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < size.Dx(); x++ {
+				var a, b [3]int
+				minA, diff := 255, 0
+				for c := range cover {
+					a[c] = int(cover[c].Pix[cover[c].PixOffset(cover[c].Rect.Min.X+x, cover[c].Rect.Min.Y+y)])
+					b[c] = int(hidden[c].Pix[hidden[c].PixOffset(hidden[c].Rect.Min.X+x, hidden[c].Rect.Min.Y+y)])
+					if a[c] < minA {
+						minA = a[c]
+					}
+					diff += a[c] - b[c]
+				}
+				// alpha 取三个通道的最小二乘解，但不能低于 255-minA，否则白底上还原不了表图
+				alphaVal := clamp(255-(diff+1)/3, 255-minA, 255)
+				alpha.Pix[alpha.PixOffset(x, y)] = uint8(alphaVal)
+				if alphaVal == 0 {
+					continue
+				}
+				// 用取整后的 alpha 反推颜色，白底上的误差只来自最后的取整
+				for c := range rgb {
+					v := (a[c] - 255 + alphaVal) * 255
+					rgb[c].Pix[rgb[c].PixOffset(x, y)] = uint8(clamp((v+alphaVal/2)/alphaVal, 0, 255))
+				}
+			}
+		}
+	})
+	return rgb, alpha
+}
+
+// AddColorMask combines three color channels and an alpha channel into one image
+func AddColorMask(imgR, imgG, imgB, alpha *image.Gray) *image.NRGBA {
+	return addColorMask(context.Background(), imgR, imgG, imgB, alpha)
+}
+
+// addColorMask implements AddColorMask, giving up early once ctx is done
+func addColorMask(ctx context.Context, imgR, imgG, imgB, alpha *image.Gray) *image.NRGBA {
+	size := overlap(overlap(imgR.Bounds(), imgG.Bounds()), overlap(imgB.Bounds(), alpha.Bounds()))
+	result := image.NewNRGBA(size)
+
+	boundsR, boundsG, boundsB, boundsA := imgR.Bounds(), imgG.Bounds(), imgB.Bounds(), alpha.Bounds()
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < size.Dx(); x++ {
+				result.Set(x, y, color.NRGBA{
+					R: imgR.GrayAt(boundsR.Min.X+x, boundsR.Min.Y+y).Y,
+					G: imgG.GrayAt(boundsG.Min.X+x, boundsG.Min.Y+y).Y,
+					B: imgB.GrayAt(boundsB.Min.X+x, boundsB.Min.Y+y).Y,
+					A: alpha.GrayAt(boundsA.Min.X+x, boundsA.Min.Y+y).Y,
+				})
+			}
+		}
+	})
+	return result
+}
+
+// splitChannels returns the red, green and blue channels of img as grayscale images
+func splitChannels(ctx context.Context, img image.Image) [3]*image.Gray {
+	bounds := img.Bounds()
+	rect := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+	channels := [3]*image.Gray{image.NewGray(rect), image.NewGray(rect), image.NewGray(rect)}
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				channels[0].Set(x, y, color.Gray{Y: to8(uint16(r))})
+				channels[1].Set(x, y, color.Gray{Y: to8(uint16(g))})
+				channels[2].Set(x, y, color.Gray{Y: to8(uint16(b))})
+			}
+		}
+	})
+	return channels
+}
+
+// averageGray returns the rounded per-pixel mean of three grayscale images
+func averageGray(ctx context.Context, imgX, imgY, imgZ *image.Gray) *image.Gray {
+	boundsX, boundsY, boundsZ := imgX.Bounds(), imgY.Bounds(), imgZ.Bounds()
+	size := overlap(overlap(boundsX, boundsY), boundsZ)
+	result := image.NewGray(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < size.Dx(); x++ {
+				sum := int(imgX.GrayAt(boundsX.Min.X+x, boundsX.Min.Y+y).Y) +
+					int(imgY.GrayAt(boundsY.Min.X+x, boundsY.Min.Y+y).Y) +
+					int(imgZ.GrayAt(boundsZ.Min.X+x, boundsZ.Min.Y+y).Y)
+				result.Set(x, y, color.Gray{Y: uint8((sum + 1) / 3)})
+			}
+		}
+	})
+	return result
+}
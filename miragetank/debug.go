@@ -0,0 +1,32 @@
+package miragetank
+
+import (
+	"image"
+	"path/filepath"
+)
+
+// Names of the layers MirageTank.DebugDir receives, numbered in pipeline order
+const (
+	debugResizedA    = "1-resized-a"
+	debugResizedB    = "2-resized-b"
+	debugGrayA       = "3-gray-a"
+	debugGrayB       = "4-gray-b"
+	debugAdjustedA   = "5-adjusted-a"
+	debugAdjustedB   = "6-adjusted-b"
+	debugLinearDodge = "7-linear-dodge"
+	debugDivided     = "8-divided"
+	debugFinal       = "9-final"
+)
+
+// dump writes img as <name>.png into m.DebugDir, or does nothing when it is
+// not set. img is the pipeline's own layer, so dumping costs an encode but no
+// extra rendering; a failed write is logged and does not stop the render
+func (m *MirageTank) dump(name string, img image.Image) {
+	if m.DebugDir == "" {
+		return
+	}
+	path := filepath.Join(m.DebugDir, name+".png")
+	if err := (&MirageTank{Format: PNG}).WriteFile(img, path); err != nil {
+		logger.Warn("writing debug layer failed", "path", path, "err", err)
+	}
+}
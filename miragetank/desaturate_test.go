@@ -0,0 +1,36 @@
+package miragetank
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestDesaturateExtremes checks that pure white and pure black map exactly to
+// 255 and 0, both through the *image.RGBA fast path and through At
+func TestDesaturateExtremes(t *testing.T) {
+	tests := []struct {
+		name string
+		c    color.Color
+		want uint8
+	}{
+		{"white", color.White, 255},
+		{"black", color.Black, 0},
+		{"red", color.RGBA{R: 255, A: 255}, 128},
+	}
+	for _, tt := range tests {
+		rgba := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		wide := image.NewRGBA64(image.Rect(0, 0, 2, 2))
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				rgba.Set(x, y, tt.c)
+				wide.Set(x, y, tt.c)
+			}
+		}
+		for _, img := range []image.Image{rgba, wide} {
+			if got := Desaturate(img).GrayAt(1, 1).Y; got != tt.want {
+				t.Errorf("%s %T: got %d, want %d", tt.name, img, got, tt.want)
+			}
+		}
+	}
+}
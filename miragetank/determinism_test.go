@@ -0,0 +1,66 @@
+package miragetank
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// TestRenderIndependentOfGOMAXPROCS renders the testdata pair with one band
+// and with eight and checks the encoded tanks are byte for byte identical
+func TestRenderIndependentOfGOMAXPROCS(t *testing.T) {
+	cover, err := os.Open("testdata/cover.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cover.Close()
+	hidden, err := os.Open("testdata/hidden.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hidden.Close()
+	imgA, imgB, err := DecodePair(cover, hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renders := map[string]func(m *MirageTank) (image.Image, error){
+		"default": func(m *MirageTank) (image.Image, error) { return m.Render(imgA, imgB) },
+		"filters": func(m *MirageTank) (image.Image, error) {
+			m.Sharpen, m.AutoContrast, m.EdgeEnhance, m.AlphaBlur = 0.8, true, 0.5, 0.7
+			return m.Render(imgA, imgB)
+		},
+		"highPrecision": func(m *MirageTank) (image.Image, error) {
+			m.HighPrecision, m.Gamma = true, 2.2
+			return m.Render(imgA, imgB)
+		},
+		"dither": func(m *MirageTank) (image.Image, error) {
+			m.Dither = DitherAll
+			return m.Render(imgA, imgB)
+		},
+		"exactColor": func(m *MirageTank) (image.Image, error) {
+			m.ExactColor = true
+			return m.RenderColor(imgA, imgB)
+		},
+	}
+	encode := func(procs int, render func(m *MirageTank) (image.Image, error)) []byte {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+		m := NewMirageTank()
+		tank, err := render(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := m.Encode(&buf, tank); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for name, render := range renders {
+		if !bytes.Equal(encode(1, render), encode(8, render)) {
+			t.Errorf("%s: output differs between GOMAXPROCS 1 and 8", name)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package miragetank
+
+import (
+	"image"
+	"testing"
+)
+
+// TestEdgeEnhance runs EdgeEnhance on a fixture with a vertical step from 40
+// to 160 and checks that both sides of the edge brighten by strength times the
+// scaled Sobel magnitude of 120, while the flat areas stay untouched
+func TestEdgeEnhance(t *testing.T) {
+	step := image.NewGray(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			step.Pix[step.PixOffset(x, y)] = 40
+			if x >= 4 {
+				step.Pix[step.PixOffset(x, y)] = 160
+			}
+		}
+	}
+
+	tests := []struct {
+		strength float64
+		row      [8]uint8
+	}{
+		{0, [8]uint8{40, 40, 40, 40, 160, 160, 160, 160}},
+		{0.5, [8]uint8{40, 40, 40, 100, 220, 160, 160, 160}},
+		// 超过 255 的部分被截断
+		{2, [8]uint8{40, 40, 40, 255, 255, 160, 160, 160}},
+	}
+	for _, tt := range tests {
+		got := EdgeEnhance(step, tt.strength)
+		for y := 0; y < 8; y++ {
+			for x, want := range tt.row {
+				if v := got.GrayAt(x, y).Y; v != want {
+					t.Fatalf("strength %v: pixel %d,%d is %d, want %d", tt.strength, x, y, v, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package miragetank
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors wrapped by the render, build and encode functions, so callers can tell
+// the failures apart with errors.Is. The wrapping error adds the details, e.g.
+// the underlying decoder error or the two sizes that did not match
+var (
+	// ErrDecode means a source image could not be decoded. ErrDecodeCover and
+	// ErrDecodeHidden wrap it when it is known which of the two failed
+	ErrDecode = errors.New("decode")
+	// ErrDecodeCover means the cover image could not be decoded
+	ErrDecodeCover = fmt.Errorf("%w cover", ErrDecode)
+	// ErrDecodeHidden means the hidden image could not be decoded
+	ErrDecodeHidden = fmt.Errorf("%w hidden image", ErrDecode)
+	// ErrBoundsMismatch means two layers of the pipeline ended up with different sizes
+	ErrBoundsMismatch = errors.New("bounds mismatch")
+	// ErrSizeMismatch is another name for ErrBoundsMismatch
+	ErrSizeMismatch = ErrBoundsMismatch
+	// ErrEncode means the finished tank could not be encoded
+	ErrEncode = errors.New("encode")
+)
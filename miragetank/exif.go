@@ -0,0 +1,116 @@
+package miragetank
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// exifOrientation returns the EXIF orientation tag (1-8) of a JPEG file,
+// or 1 (already upright) when the file has no readable orientation
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// 逐段扫描 JPEG 标记，找到 APP1 里的 Exif 数据
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from IFD0 of a TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + 12*e
+		if entry+12 > len(tiff) {
+			break
+		}
+		// 0x0112 是 Orientation，类型为 SHORT，值直接存放在条目里
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation flips and rotates img so that an image stored with the given
+// EXIF orientation displays upright. Orientation 1 returns img unchanged
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// 5-8 都包含 90 度旋转，宽高互换
+		dw, dh = h, w
+	}
+	result := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	parallelRows(dh, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < dw; x++ {
+				var sx, sy int
+				switch orientation {
+				case 2: // 水平翻转
+					sx, sy = w-1-x, y
+				case 3: // 旋转 180 度
+					sx, sy = w-1-x, h-1-y
+				case 4: // 垂直翻转
+					sx, sy = x, h-1-y
+				case 5: // 沿主对角线翻转
+					sx, sy = y, x
+				case 6: // 顺时针旋转 90 度
+					sx, sy = y, h-1-x
+				case 7: // 沿副对角线翻转
+					sx, sy = w-1-y, h-1-x
+				case 8: // 逆时针旋转 90 度
+					sx, sy = w-1-y, x
+				}
+				result.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+			}
+		}
+	})
+	return result
+}
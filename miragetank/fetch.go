@@ -0,0 +1,145 @@
+//go:build !js
+
+package miragetank
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fetcher downloads source images over http and https
+type Fetcher struct {
+	// Client sends the requests; nil means a client that follows at most
+	// 10 redirects and only to http or https URLs
+	Client *http.Client
+	// Timeout bounds each download, including redirects and the body; 0 means no limit
+	Timeout time.Duration
+	// MaxBytes is the largest response body accepted; 0 means no limit
+	MaxBytes int64
+}
+
+// DefaultFetcher is the Fetcher used by BuildFromURLs and by Build for URL sources
+var DefaultFetcher = &Fetcher{Timeout: 30 * time.Second, MaxBytes: 32 << 20}
+
+// errTooLarge is returned when a response body is larger than Fetcher.MaxBytes
+var errTooLarge = errors.New("response body too large")
+
+// Fetch downloads rawURL and returns its body, which must be an image
+func (f *Fetcher) Fetch(rawURL string) ([]byte, error) {
+	return f.FetchContext(context.Background(), rawURL)
+}
+
+// FetchContext is Fetch that gives up with ctx.Err() once ctx is done
+func (f *Fetcher) FetchContext(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if !isHTTP(u) {
+		return nil, fmt.Errorf("fetch %s: unsupported scheme %q", rawURL, u.Scheme)
+	}
+
+	client := f.Client
+	if client == nil {
+		client = &http.Client{CheckRedirect: checkRedirect}
+	}
+	if f.Timeout > 0 {
+		// 复制一份，避免修改调用方传入的 Client
+		c := *client
+		c.Timeout = f.Timeout
+		client = &c
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", rawURL, resp.Status)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return nil, fmt.Errorf("fetch %s: not an image (Content-Type %q)", rawURL, resp.Header.Get("Content-Type"))
+	}
+
+	body := io.Reader(resp.Body)
+	if f.MaxBytes > 0 {
+		if resp.ContentLength > f.MaxBytes {
+			return nil, fmt.Errorf("fetch %s: %w", rawURL, errTooLarge)
+		}
+		// 多读一个字节，用来判断是否超过上限
+		body = io.LimitReader(resp.Body, f.MaxBytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", rawURL, err)
+	}
+	if f.MaxBytes > 0 && int64(len(data)) > f.MaxBytes {
+		return nil, fmt.Errorf("fetch %s: %w", rawURL, errTooLarge)
+	}
+	return data, nil
+}
+
+// checkRedirect stops redirect chains that are too long or leave http and https
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !isHTTP(req.URL) {
+		return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+	}
+	return nil
+}
+
+// BuildFromURLs creates the 'mirage tank' image like Build with the default
+// ratios, downloading cover and hidden with DefaultFetcher
+func BuildFromURLs(coverURL, hiddenURL, targetName string, shrink float64) error {
+	for _, s := range []string{coverURL, hiddenURL} {
+		if !isURL(s) {
+			return fmt.Errorf("%s is not an http or https URL", s)
+		}
+	}
+	return Build(coverURL, hiddenURL, targetName, shrink, DefaultForegroundRatio, DefaultBackgroundRatio, Stretch)
+}
+
+// openSource opens a source image, downloading it first when name is an http or
+// https URL and reading standard input when it is Stdio. ctx bounds the download
+func openSource(ctx context.Context, name string) (io.ReadCloser, error) {
+	if name == Stdio {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if isURL(name) {
+		data, err := DefaultFetcher.FetchContext(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return os.Open(name)
+}
+
+// isURL reports whether name looks like an http or https URL rather than a file path
+func isURL(name string) bool {
+	u, err := url.Parse(name)
+	return err == nil && isHTTP(u) && u.Host != ""
+}
+
+// isHTTP reports whether u uses the http or https scheme
+func isHTTP(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
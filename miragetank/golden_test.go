@@ -0,0 +1,62 @@
+package miragetank
+
+import (
+	"flag"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/golden.png from the current output")
+
+// decodeNRGBA reads the PNG at name as an *image.NRGBA
+func decodeNRGBA(t *testing.T, name string) *image.NRGBA {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba
+	}
+	nrgba := image.NewNRGBA(img.Bounds())
+	draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return nrgba
+}
+
+func TestBuildGolden(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "tank.png")
+	err := Build("testdata/cover.png", "testdata/hidden.png", out, 1, DefaultForegroundRatio, DefaultBackgroundRatio, Stretch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile("testdata/golden.png", data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, want := decodeNRGBA(t, out), decodeNRGBA(t, "testdata/golden.png")
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds %v, want %v", got.Bounds(), want.Bounds())
+	}
+	for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+		for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+			if g, w := got.NRGBAAt(x, y), want.NRGBAAt(x, y); g != w {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
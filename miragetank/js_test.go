@@ -0,0 +1,40 @@
+package miragetank
+
+import (
+	"go/build"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestJSImports checks that the package as built for js/wasm imports neither
+// os nor net/http, so Render and the io.Reader entry points stay pure there
+func TestJSImports(t *testing.T) {
+	ctx := build.Default
+	ctx.GOOS, ctx.GOARCH = "js", "wasm"
+	pkg, err := ctx.ImportDir(".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range pkg.Imports {
+		if path == "os" || path == "net/http" {
+			t.Errorf("js/wasm build imports %s", path)
+		}
+	}
+}
+
+// TestJSBuild compiles the package with GOOS=js GOARCH=wasm
+func TestJSBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the js/wasm build in short mode")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	cmd := exec.Command(gobin, "build", ".")
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("GOOS=js GOARCH=wasm go build: %v\n%s", err, out)
+	}
+}
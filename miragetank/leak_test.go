@@ -0,0 +1,27 @@
+package miragetank
+
+import (
+	"image/color"
+	"testing"
+)
+
+// TestLeakBackground checks that LeakBackground returns the lightest gray on
+// which the golden tank's hidden image outweighs its cover
+func TestLeakBackground(t *testing.T) {
+	tank := decodeNRGBA(t, "testdata/golden.png")
+	gray, composite := LeakBackground(tank)
+	if gray != 117 {
+		t.Errorf("LeakBackground = %d, want 117", gray)
+	}
+	if composite.Bounds().Size() != tank.Bounds().Size() {
+		t.Errorf("composite is %v, want %v", composite.Bounds(), tank.Bounds())
+	}
+
+	cover, hidden := ExtractCover(tank), ExtractHidden(tank)
+	for g, wantLeak := range map[uint8]bool{gray: true, gray + 1: false} {
+		onGray := Desaturate(CompositeOver(tank, color.Gray{Y: g}))
+		if leaks := SSIM(onGray, hidden) >= SSIM(onGray, cover); leaks != wantLeak {
+			t.Errorf("gray %d: leaks %v, want %v", g, leaks, wantLeak)
+		}
+	}
+}
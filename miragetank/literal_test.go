@@ -0,0 +1,32 @@
+package miragetank
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// TestStructLiteralMatchesNew checks that a MirageTank written as a struct
+// literal with just the ratios and Shrink renders the same tank as
+// NewMirageTank, so zero values of the other fields keep their defaults
+func TestStructLiteralMatchesNew(t *testing.T) {
+	cover, hidden := decodeNRGBA(t, "testdata/cover.png"), decodeNRGBA(t, "testdata/hidden.png")
+	literal := &MirageTank{Shrink: 1, ForegroundRatio: DefaultForegroundRatio, BackgroundRatio: DefaultBackgroundRatio}
+	for _, color := range []bool{false, true} {
+		render := (*MirageTank).Render
+		if color {
+			render = (*MirageTank).RenderColor
+		}
+		want, err := render(NewMirageTank(), cover, hidden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := render(literal, cover, hidden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+			t.Errorf("color %v: struct literal renders a different tank than NewMirageTank", color)
+		}
+	}
+}
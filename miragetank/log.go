@@ -0,0 +1,18 @@
+package miragetank
+
+import "log/slog"
+
+// logger receives all diagnostic output. The default, see defaultLogger, writes
+// info and above, so the debug-level progress messages of Build stay quiet
+var logger = defaultLogger()
+
+// SetLogger routes the package's log output to l; nil restores the default.
+// slog.New(slog.NewTextHandler(io.Discard, nil)) silences it entirely. Debug
+// messages include how long every stage of a build took. Call it before
+// building any tanks
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = defaultLogger()
+	}
+	logger = l
+}
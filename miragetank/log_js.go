@@ -0,0 +1,9 @@
+package miragetank
+
+import "log/slog"
+
+// defaultLogger returns the logger used until SetLogger replaces it. Under js
+// that is slog.Default, which reaches the browser console without importing os
+func defaultLogger() *slog.Logger {
+	return slog.Default()
+}
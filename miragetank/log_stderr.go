@@ -0,0 +1,14 @@
+//go:build !js
+
+package miragetank
+
+import (
+	"log/slog"
+	"os"
+)
+
+// defaultLogger returns the logger used until SetLogger replaces it: a text
+// handler on stderr
+func defaultLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, nil))
+}
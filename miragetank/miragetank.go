@@ -0,0 +1,959 @@
+// Package miragetank builds 'mirage tank' images: PNGs with an alpha channel
+// that show one picture on a white background and another on a black one.
+// MirageTank holds the settings and renders decoded images in memory; Build
+// and its variants read the sources from files or URLs and write the tank to
+// a file or to standard output
+package miragetank
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/HugoSmits86/nativewebp"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"io"
+	"math"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GrayMethod selects the formula Desaturate uses to turn a color into gray
+type GrayMethod int
+
+const (
+	// Lightness averages the largest and smallest channel, (max+min)/2
+	Lightness GrayMethod = iota
+	// Luminosity weights the channels by perceived brightness, 0.299R+0.587G+0.114B
+	Luminosity
+	// Average is the plain mean of the three channels
+	Average
+	// LinearLuminance decodes the channels to linear light, weights them by
+	// 0.2126R+0.7152G+0.0722B and encodes the result back to sRGB. Unlike the
+	// other methods it keeps the brightness the eye sees, so saturated colors
+	// are not rendered too dark
+	LinearLuminance
+)
+
+// Desaturate converts an RGB image to a desaturated grayscale image
+func Desaturate(img image.Image) *image.Gray {
+	return DesaturateMethod(img, Lightness)
+}
+
+// DesaturateMethod converts an RGB image to grayscale using the given method
+func DesaturateMethod(img image.Image, method GrayMethod) *image.Gray {
+	return desaturateMethod(context.Background(), img, method)
+}
+
+// desaturateMethod implements DesaturateMethod, giving up early once ctx is done
+func desaturateMethod(ctx context.Context, img image.Image, method GrayMethod) *image.Gray {
+	bounds := img.Bounds()
+	grayImg := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	// resize 的输出都是 *image.RGBA，直接读 Pix 可以省掉每个像素的接口调用
+	rgba, isRGBA := img.(*image.RGBA)
+	toGray := grayFunc(method)
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			out := grayImg.Pix[grayImg.PixOffset(0, y):]
+			for x := 0; x < bounds.Dx(); x++ {
+				var r, g, b uint32
+				if isRGBA {
+					i := rgba.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+					r, g, b = uint32(rgba.Pix[i]), uint32(rgba.Pix[i+1]), uint32(rgba.Pix[i+2])
+				} else {
+					r, g, b, _ = img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					// 16 位源图四舍五入到 8 位，8 位源图的值保持不变
+					r, g, b = uint32(to8(uint16(r))), uint32(to8(uint16(g))), uint32(to8(uint16(b)))
+				}
+				out[x] = toGray(r, g, b)
+			}
+		}
+	})
+	return grayImg
+}
+
+// grayFunc returns the per-pixel formula for method. The channels passed to it
+// are already reduced to 8 bits, so every formula works in the 0-255 range
+func grayFunc(method GrayMethod) func(r, g, b uint32) uint8 {
+	switch method {
+	case Luminosity:
+		return func(r, g, b uint32) uint8 {
+			return uint8((299*r + 587*g + 114*b + 500) / 1000)
+		}
+	case Average:
+		return func(r, g, b uint32) uint8 {
+			return uint8((r + g + b + 1) / 3)
+		}
+	case LinearLuminance:
+		return func(r, g, b uint32) uint8 {
+			return to8(linearLuminance16(r*257, g*257, b*257))
+		}
+	default:
+		return func(r, g, b uint32) uint8 {
+			maxVal := max(max(r, g), b)
+			minVal := min(min(r, g), b)
+			// 两个 8 位值取中点时四舍五入，否则奇数和会向下偏一级
+			return uint8((maxVal + minVal + 1) / 2)
+		}
+	}
+}
+
+// AdjustLightness adjusts the lightness of a grayscale image
+func AdjustLightness(img *image.Gray, ratio float64) *image.Gray {
+	return adjustLightness(context.Background(), img, ratio)
+}
+
+// adjustLightness implements AdjustLightness, giving up early once ctx is done
+func adjustLightness(ctx context.Context, img *image.Gray, ratio float64) *image.Gray {
+	return adjustLightnessMasked(ctx, img, ratio, nil)
+}
+
+// adjustLightnessMasked is adjustLightness with the ratio scaled per pixel by
+// mask, which must be at least as large as img: white keeps the full ratio and
+// black leaves the pixel unchanged. A nil mask applies the ratio everywhere
+func adjustLightnessMasked(ctx context.Context, img *image.Gray, ratio float64, mask *image.Gray) *image.Gray {
+	bounds := img.Bounds()
+	adjusted := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				gray := img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y
+				ratio := ratio
+				if mask != nil {
+					ratio *= float64(mask.Pix[mask.PixOffset(mask.Rect.Min.X+x, mask.Rect.Min.Y+y)]) / 255
+				}
+				var newGray float64
+				if ratio > 0 {
+					newGray = float64(gray)*(1-ratio) + 255*ratio
+				} else {
+					newGray = float64(gray) * (1 + ratio)
+				}
+				// 先四舍五入再截断到 [0,255]，避免比例越界时 uint8 溢出回绕
+				adjusted.Set(x, y, color.Gray{Y: uint8(clamp(int(newGray+0.5), 0, 255))})
+			}
+		}
+	})
+	return adjusted
+}
+
+// Invert inverts the color of the grayscale image
+func Invert(img *image.Gray) *image.Gray {
+	return invert(context.Background(), img)
+}
+
+// invert implements Invert, giving up early once ctx is done
+func invert(ctx context.Context, img *image.Gray) *image.Gray {
+	bounds := img.Bounds()
+	inverted := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				gray := img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y
+				inverted.Set(x, y, color.Gray{Y: 255 - gray})
+			}
+		}
+	})
+	return inverted
+}
+
+// Gamma applies a power curve to a grayscale image, mapping each value v to 255*(v/255)^g.
+// A g of 2.2 roughly converts sRGB to linear light and 1/2.2 converts back
+func Gamma(img *image.Gray, g float64) *image.Gray {
+	return gamma(context.Background(), img, g)
+}
+
+// gamma implements Gamma, giving up early once ctx is done
+func gamma(ctx context.Context, img *image.Gray, g float64) *image.Gray {
+	var table [256]uint8
+	for i := range table {
+		table[i] = uint8(clamp(int(255*math.Pow(float64(i)/255, g)+0.5), 0, 255))
+	}
+	return applyTable(ctx, img, &table)
+}
+
+// Posterize quantizes a grayscale image into levels evenly spaced gray values,
+// the darkest 0 and the brightest 255, for a flat poster-like look. Every pixel
+// takes the nearest level; fewer than 2 levels leave the image unchanged
+func Posterize(img *image.Gray, levels int) *image.Gray {
+	return posterize(context.Background(), img, levels)
+}
+
+// posterize implements Posterize, giving up early once ctx is done
+func posterize(ctx context.Context, img *image.Gray, levels int) *image.Gray {
+	var table [256]uint8
+	for i := range table {
+		table[i] = uint8(quantize(i, 255, levels))
+	}
+	return applyTable(ctx, img, &table)
+}
+
+// quantize rounds v from 0 to full to the nearest of levels evenly spaced
+// values that include 0 and full; fewer than 2 levels return v
+func quantize(v, full, levels int) int {
+	if levels < 2 {
+		return v
+	}
+	// 先四舍五入到最近的档位，再把档位换算回 0 到 full 之间
+	steps := levels - 1
+	level := (v*steps + full/2) / full
+	return (level*full + steps/2) / steps
+}
+
+// AutoContrast stretches the histogram of a grayscale image so that its darkest
+// value becomes 0 and its brightest 255. clipLowPct and clipHighPct percent of
+// the pixels at either end are ignored when finding those values, so a few
+// outliers such as dust on a scan do not prevent the stretch
+func AutoContrast(img *image.Gray, clipLowPct, clipHighPct float64) *image.Gray {
+	return autoContrast(context.Background(), img, clipLowPct, clipHighPct)
+}
+
+// autoContrast implements AutoContrast, giving up early once ctx is done
+func autoContrast(ctx context.Context, img *image.Gray, clipLowPct, clipHighPct float64) *image.Gray {
+	bounds := img.Bounds()
+	var histogram [256]int
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for _, gray := range row[:bounds.Dx()] {
+			histogram[gray]++
+		}
+	}
+
+	low, high := clipRange(histogram[:], clipLowPct, clipHighPct)
+	var table [256]uint8
+	for i := range table {
+		if high <= low {
+			table[i] = uint8(i)
+			continue
+		}
+		table[i] = uint8(clamp((255*(i-low)+(high-low)/2)/(high-low), 0, 255))
+	}
+	return applyTable(ctx, img, &table)
+}
+
+// clipRange returns the darkest and brightest values of histogram once
+// clipLowPct and clipHighPct percent of the counted pixels are dropped from
+// either end
+func clipRange(histogram []int, clipLowPct, clipHighPct float64) (low, high int) {
+	total := 0
+	for _, count := range histogram {
+		total += count
+	}
+
+	// 按百分比裁掉两端的像素，找到实际使用的最暗和最亮值
+	low, high = 0, len(histogram)-1
+	for count := 0; low < len(histogram)-1; low++ {
+		count += histogram[low]
+		if float64(count) > float64(total)*clipLowPct/100 {
+			break
+		}
+	}
+	for count := 0; high > 0; high-- {
+		count += histogram[high]
+		if float64(count) > float64(total)*clipHighPct/100 {
+			break
+		}
+	}
+	return low, high
+}
+
+// applyTable maps every value of a grayscale image through table
+func applyTable(ctx context.Context, img *image.Gray, table *[256]uint8) *image.Gray {
+	bounds := img.Bounds()
+	result := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				gray := img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y
+				result.Set(x, y, color.Gray{Y: table[gray]})
+			}
+		}
+	})
+	return result
+}
+
+// LinearDodgeBlend blends two grayscale images.
+// Like the other blends it only covers the area both images share, see overlap
+func LinearDodgeBlend(imgX, imgY *image.Gray) *image.Gray {
+	return linearDodgeBlend(context.Background(), imgX, imgY)
+}
+
+// linearDodgeBlend implements LinearDodgeBlend, giving up early once ctx is done
+func linearDodgeBlend(ctx context.Context, imgX, imgY *image.Gray) *image.Gray {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	result := image.NewGray(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+			rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < size.Dx(); x++ {
+				out[x] = linearDodgePixel(rowX[x], rowY[x])
+			}
+		}
+	})
+	return result
+}
+
+// linearDodgePixel is the per-pixel function of LinearDodgeBlend, x+y clamped at 255
+func linearDodgePixel(x, y uint8) uint8 {
+	return uint8(clamp(int(x)+int(y), 0, 255))
+}
+
+// DivideBlend blends two grayscale images in 'divide' mode
+func DivideBlend(imgX, imgY *image.Gray) *image.Gray {
+	return divideBlend(context.Background(), imgX, imgY)
+}
+
+// divideBlend implements DivideBlend, giving up early once ctx is done
+func divideBlend(ctx context.Context, imgX, imgY *image.Gray) *image.Gray {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	result := image.NewGray(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+			rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < size.Dx(); x++ {
+				out[x] = dividePixel(rowX[x], rowY[x])
+			}
+		}
+	})
+	return result
+}
+
+// dividePixel is the per-pixel function of DivideBlend, y*255/x clamped at
+// 255, with a black x giving white
+func dividePixel(x, y uint8) uint8 {
+	if x == 0 {
+		return 255
+	}
+	// 加上除数的一半再整除，四舍五入而不是向下截断
+	return uint8(clamp((int(y)*255+int(x)/2)/int(x), 0, 255))
+}
+
+// AddMask adds an alpha channel to the grayscale image
+func AddMask(imgX, imgY *image.Gray) *image.NRGBA {
+	return addMask(context.Background(), imgX, imgY)
+}
+
+// addMask implements AddMask, giving up early once ctx is done
+func addMask(ctx context.Context, imgX, imgY *image.Gray) *image.NRGBA {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	result := image.NewNRGBA(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+			rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < size.Dx(); x++ {
+				gray, alpha := rowX[x], rowY[x]
+				out[4*x], out[4*x+1], out[4*x+2], out[4*x+3] = gray, gray, gray, alpha
+			}
+		}
+	})
+	return result
+}
+
+// raiseAlpha raises every alpha of tank below floor to floor, in place, and
+// lowers the color so that the pixel composited over white stays the same:
+// 255-(255-c)*a/floor. It returns tank
+func raiseAlpha(ctx context.Context, tank *image.NRGBA, floor uint8) *image.NRGBA {
+	if floor == 0 {
+		return tank
+	}
+	bounds := tank.Bounds()
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := tank.Pix[tank.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			for x := 0; x < bounds.Dx(); x++ {
+				a := int(row[4*x+3])
+				if a >= int(floor) {
+					continue
+				}
+				// 白底上看到的是 255-(255-c)*a/255，提高 alpha 后按比例调暗颜色保持不变
+				for c := 0; c < 3; c++ {
+					row[4*x+c] = uint8(255 - ((255-int(row[4*x+c]))*a+int(floor)/2)/int(floor))
+				}
+				row[4*x+3] = floor
+			}
+		}
+	})
+	return tank
+}
+
+// Premultiply converts a straight-alpha tank to premultiplied RGBA, rounding
+// every color channel times alpha to the nearest 8-bit value
+func Premultiply(tank *image.NRGBA) *image.RGBA {
+	return premultiply(context.Background(), tank)
+}
+
+// premultiply implements Premultiply, giving up early once ctx is done
+func premultiply(ctx context.Context, tank *image.NRGBA) *image.RGBA {
+	bounds := tank.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := tank.Pix[tank.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < bounds.Dx(); x++ {
+				a := uint32(row[4*x+3])
+				for c := 0; c < 3; c++ {
+					out[4*x+c] = uint8((uint32(row[4*x+c])*a + 127) / 255)
+				}
+				out[4*x+3] = uint8(a)
+			}
+		}
+	})
+	return result
+}
+
+// Build creates the 'mirage tank' image: cover is what shows on a white
+// background and hidden what shows on a black one.
+// foregroundRatio lightens cover and backgroundRatio darkens hidden;
+// DefaultForegroundRatio and DefaultBackgroundRatio match the original behavior
+func Build(cover, hidden, targetName string, shrink, foregroundRatio, backgroundRatio float64, mode ResizeMode) error {
+	m := newBuildTank(shrink, foregroundRatio, backgroundRatio, mode)
+	m.Format = FormatFor(targetName)
+	return BuildFile(m, (*MirageTank).Render, cover, hidden, targetName)
+}
+
+// BuildColor creates a colored 'mirage tank' image, see MirageTank.RenderColor.
+// The parameters are the same as for Build
+func BuildColor(cover, hidden, targetName string, shrink, foregroundRatio, backgroundRatio float64, mode ResizeMode) error {
+	m := newBuildTank(shrink, foregroundRatio, backgroundRatio, mode)
+	m.Format = FormatFor(targetName)
+	return BuildFile(m, (*MirageTank).RenderColor, cover, hidden, targetName)
+}
+
+// BuildMaxDim creates the 'mirage tank' image like Build with the default ratios,
+// shrinking the output so its longer side is at most maxDim pixels
+func BuildMaxDim(cover, hidden, targetName string, maxDim int) error {
+	m := NewMirageTank()
+	m.MaxDim = maxDim
+	m.Format = FormatFor(targetName)
+	return BuildFile(m, (*MirageTank).Render, cover, hidden, targetName)
+}
+
+// BuildFlattenedJPEG writes only the cover side of the 'mirage tank' to targetName:
+// the tank is flattened over bg (white if nil) and saved as a JPEG with the given
+// quality (0 for the default). The hidden image does not survive, so the result
+// is a lightweight preview to share next to the real PNG, not a working tank
+func BuildFlattenedJPEG(cover, hidden, targetName string, shrink float64, bg color.Color, quality int) error {
+	if !IsJPEGName(targetName) {
+		return fmt.Errorf("%s: flattened output must be .jpg or .jpeg", targetName)
+	}
+	m := NewMirageTank()
+	m.Shrink = shrink
+	m.Format = FlattenedJPEG
+	m.Background = bg
+	m.Quality = quality
+	return BuildFile(m, (*MirageTank).Render, cover, hidden, targetName)
+}
+
+// Validate decodes cover and hidden and checks that a tank could be built from
+// them with the default settings, printing their formats and sizes. It stops
+// before the blend and writes nothing
+func Validate(cover, hidden string) error {
+	var imgs [2]image.Image
+	var formats [2]string
+	for i, name := range []string{cover, hidden} {
+		f, err := openSource(context.Background(), name)
+		if err != nil {
+			return err
+		}
+		imgs[i], formats[i], err = decodeImage(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%w %s: %w", ErrDecode, name, err)
+		}
+	}
+	if err := checkSources(imgs[0], imgs[1]); err != nil {
+		return err
+	}
+
+	width, height := NewMirageTank().canvas(imgs[0].Bounds(), imgs[1].Bounds())
+	logger.Info("valid pair",
+		"cover", cover, "coverFormat", formats[0], "coverSize", imgs[0].Bounds().Size(),
+		"hidden", hidden, "hiddenFormat", formats[1], "hiddenSize", imgs[1].Bounds().Size(),
+		"output", image.Pt(width, height))
+	return nil
+}
+
+// Stdio is the source or output name that stands for standard input or output
+const Stdio = "-"
+
+// LoadImage decodes the image at name, which may be a file, an http(s) URL or Stdio
+func LoadImage(name string) (image.Image, error) {
+	f, err := openSource(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := decodeImage(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ErrDecode, name, err)
+	}
+	return img, nil
+}
+
+// WriteFile encodes img with m.Encode into targetName, or to standard output
+// when it is Stdio. A file only replaces targetName once it is complete
+func (m *MirageTank) WriteFile(img image.Image, targetName string) error {
+	return m.writeFile(context.Background(), img, targetName)
+}
+
+// writeFile implements WriteFile, giving up early once ctx is done
+func (m *MirageTank) writeFile(ctx context.Context, img image.Image, targetName string) error {
+	out, err := createOutput(targetName)
+	if err != nil {
+		return err
+	}
+	if err := m.EncodeContext(ctx, out, img); err != nil {
+		out.Abort()
+		return fmt.Errorf("%s: %w", targetName, err)
+	}
+	return out.Close()
+}
+
+// WriteBytes writes data, e.g. the tank FitBytes encoded, into targetName the
+// same way WriteFile does, or to standard output when it is Stdio
+func WriteBytes(data []byte, targetName string) error {
+	out, err := createOutput(targetName)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Abort()
+		return fmt.Errorf("%s: %w", targetName, err)
+	}
+	return out.Close()
+}
+
+// IsJPEGName reports whether name has a .jpg or .jpeg extension
+func IsJPEGName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// RenderFunc renders a tank for BuildFile, e.g. (*MirageTank).Render or
+// (*MirageTank).RenderColor, or a function wrapping one of them
+type RenderFunc func(m *MirageTank, a, b image.Image) (image.Image, error)
+
+// BuildFile decodes cover and hidden, which may be files, http(s) URLs or Stdio,
+// renders them with render and writes the tank to targetName with m.WriteFile
+func BuildFile(m *MirageTank, render RenderFunc, cover, hidden, targetName string) error {
+	logger.Debug("start processing", "cover", cover, "hidden", hidden, "output", targetName)
+	imgA, imgB, err := openPair(context.Background(), cover, hidden)
+	if err != nil {
+		return err
+	}
+
+	finalImage, err := render(m.beforeEncode(), imgA, imgB)
+	if err != nil {
+		return err
+	}
+	if err := m.WriteFile(finalImage, targetName); err != nil {
+		return err
+	}
+
+	logger.Debug("finished", "output", targetName)
+	return nil
+}
+
+// BothNames returns the names BuildBoth writes the grayscale and the color
+// tank to for targetName: <name>.gray<ext> and <name>.color<ext> for <name><ext>
+func BothNames(targetName string) (grayName, colorName string) {
+	ext := filepath.Ext(targetName)
+	base := strings.TrimSuffix(targetName, ext)
+	return base + ".gray" + ext, base + ".color" + ext
+}
+
+// BuildBoth writes the grayscale and the color tank of cover and hidden next
+// to each other under the names BothNames returns for targetName. Both share
+// one decode and one resize of the sources
+func (m *MirageTank) BuildBoth(cover, hidden, targetName string) error {
+	logger.Debug("start processing", "cover", cover, "hidden", hidden, "output", targetName)
+	imgA, imgB, err := openPair(context.Background(), cover, hidden)
+	if err != nil {
+		return err
+	}
+	if err := checkSources(imgA, imgB); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if err := m.checkPair(ctx, imgA, imgB); err != nil {
+		return err
+	}
+	fittedA, fittedB := m.fit(imgA, imgB)
+	grayName, colorName := BothNames(targetName)
+	variants := []struct {
+		name   string
+		render func(m *MirageTank, ctx context.Context, imgA, imgB image.Image) (image.Image, error)
+	}{
+		{grayName, (*MirageTank).renderFitted},
+		{colorName, (*MirageTank).renderColorFitted},
+	}
+	for i, v := range variants {
+		// 每个输出各占进度的一半，两次编码都完成才报告 1
+		half := m.scaled(float64(i)/float64(len(variants)), float64(i+1)/float64(len(variants)))
+		tank, err := v.render(half.beforeEncode(), ctx, fittedA, fittedB)
+		if err != nil {
+			return err
+		}
+		if err := half.WriteFile(m.colorModel(ctx, tank), v.name); err != nil {
+			return err
+		}
+		logger.Debug("finished", "output", v.name)
+	}
+	return nil
+}
+
+// openPair opens and decodes cover and hidden, which may be files, http(s) URLs or "-"
+func openPair(ctx context.Context, cover, hidden string) (image.Image, image.Image, error) {
+	imgAFile, err := openSource(ctx, cover)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer imgAFile.Close()
+
+	imgBFile, err := openSource(ctx, hidden)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer imgBFile.Close()
+
+	return DecodePair(imgAFile, imgBFile)
+}
+
+// newBuildTank returns the MirageTank described by the positional Build parameters
+func newBuildTank(shrink, foregroundRatio, backgroundRatio float64, mode ResizeMode) *MirageTank {
+	m := NewMirageTank()
+	m.Shrink = shrink
+	m.ForegroundRatio = foregroundRatio
+	m.BackgroundRatio = backgroundRatio
+	m.Resize = mode
+	return m
+}
+
+// BuildTo creates the 'mirage tank' image from two encoded images and writes it to out as PNG
+func BuildTo(cover, hidden io.Reader, out io.Writer, shrink, foregroundRatio, backgroundRatio float64, mode ResizeMode) error {
+	imgA, imgB, err := DecodePair(cover, hidden)
+	if err != nil {
+		return err
+	}
+	m := newBuildTank(shrink, foregroundRatio, backgroundRatio, mode)
+	finalImage, err := m.beforeEncode().Render(imgA, imgB)
+	if err != nil {
+		return err
+	}
+	return m.Encode(out, finalImage)
+}
+
+// Option changes one setting of the MirageTank used by RenderBytes and BuildWithOptions,
+// e.g. WithShrink(0.5) or func(m *MirageTank) { m.Sharpen = 1 }
+type Option func(m *MirageTank)
+
+// RenderBytes builds a tank from two encoded images held in memory and returns
+// it encoded, without touching the filesystem. It starts from NewMirageTank and
+// applies opts in order, so the output is a PNG unless an option sets Format
+func RenderBytes(cover, hidden []byte, opts ...Option) ([]byte, error) {
+	imgA, imgB, err := DecodePair(bytes.NewReader(cover), bytes.NewReader(hidden))
+	if err != nil {
+		return nil, err
+	}
+	m := NewMirageTank()
+	for _, opt := range opts {
+		opt(m)
+	}
+	tank, err := m.beforeEncode().Render(imgA, imgB)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := m.Encode(&buf, tank); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Render runs the 'mirage tank' pipeline on two decoded images without any file I/O,
+// using the default ratios and resizing imgB to imgA's size scaled by shrink.
+// Use a MirageTank for the other settings
+func Render(imgA, imgB image.Image, shrink float64) (*image.NRGBA, error) {
+	m := NewMirageTank()
+	m.Shrink = shrink
+	tank, err := m.Render(imgA, imgB)
+	if err != nil {
+		return nil, err
+	}
+	return tank.(*image.NRGBA), nil
+}
+
+// DecodePair decodes the white-background (cover) and black-background (hidden) images
+func DecodePair(cover, hidden io.Reader) (image.Image, image.Image, error) {
+	start := time.Now()
+	imgA, formatA, err := decodeImage(cover)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrDecodeCover, err)
+	}
+	logger.Debug("read cover", "format", formatA, "size", imgA.Bounds().Size(), "took", time.Since(start))
+
+	start = time.Now()
+	imgB, formatB, err := decodeImage(hidden)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrDecodeHidden, err)
+	}
+	logger.Debug("read hidden image", "format", formatB, "size", imgB.Bounds().Size(), "took", time.Since(start))
+	return imgA, imgB, nil
+}
+
+// decodeImage decodes one source image, turning JPEGs upright according to their EXIF orientation
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// 解码源图片。image.Decode 对动图 GIF 只返回第一帧，其余帧会被忽略；
+	// WebP 支持有损和无损两种格式，但 x/image/webp 不支持动图 WebP，会返回解码错误；
+	// 多页 TIFF 同样只读取第一页
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, exifOrientation(data))
+	}
+	return img, format, nil
+}
+
+// EncodeWebP writes img to w as a lossless WebP, keeping the alpha channel intact
+func EncodeWebP(w io.Writer, img image.Image) error {
+	// nativewebp 只输出 VP8L 无损格式，幻影坦克依赖的 alpha 值不会被改动
+	return nativewebp.Encode(w, img, nil)
+}
+
+// Resize resizes the image to the specified width and height.
+func resize(img image.Image, width, height int, interp draw.Interpolator) image.Image {
+	newImg := image.NewRGBA(image.Rect(0, 0, width, height))
+	interp.Scale(newImg, newImg.Bounds(), img, img.Bounds(), draw.Over, nil)
+	return newImg
+}
+
+// resizeFit scales img to fit inside width x height without changing its aspect ratio,
+// centering it on a canvas filled with the gray value pad
+func resizeFit(img image.Image, width, height int, pad uint8, interp draw.Interpolator) image.Image {
+	newImg := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(newImg, newImg.Bounds(), image.NewUniform(color.Gray{Y: pad}), image.Point{}, draw.Src)
+
+	interp.Scale(newImg, fitRect(img.Bounds(), width, height), img, img.Bounds(), draw.Over, nil)
+	return newImg
+}
+
+// fitRect returns the largest rectangle with the aspect ratio of bounds that
+// fits centered inside width x height
+func fitRect(bounds image.Rectangle, width, height int) image.Rectangle {
+	w, h := width, bounds.Dy()*width/bounds.Dx()
+	if h > height {
+		w, h = bounds.Dx()*height/bounds.Dy(), height
+	}
+	// 极端长宽比下缩放后的边可能为 0，至少保留 1 像素
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	x0, y0 := (width-w)/2, (height-h)/2
+	return image.Rect(x0, y0, x0+w, y0+h)
+}
+
+// clampedInterpolator wraps an Interpolator so that scaled pixels never leave the
+// per-channel value range of the source. Kernels such as CatmullRom overshoot at
+// hard edges, and the divide step amplifies those halos into visible ghosting
+type clampedInterpolator struct {
+	draw.Interpolator
+}
+
+// Scale scales like the wrapped Interpolator, then clamps the written area of dst
+func (c clampedInterpolator) Scale(dst draw.Image, dr image.Rectangle, src image.Image, sr image.Rectangle, op draw.Op, opts *draw.Options) {
+	c.Interpolator.Scale(dst, dr, src, sr, op, opts)
+	rgba, ok := dst.(*image.RGBA)
+	if !ok {
+		return
+	}
+
+	// 统计源图每个通道（预乘后的 8 位值）的最小值和最大值
+	lo := [4]uint8{255, 255, 255, 255}
+	var hi [4]uint8
+	for y := sr.Min.Y; y < sr.Max.Y; y++ {
+		for x := sr.Min.X; x < sr.Max.X; x++ {
+			r, g, b, a := src.At(x, y).RGBA()
+			for i, v := range [4]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)} {
+				if v < lo[i] {
+					lo[i] = v
+				}
+				if v > hi[i] {
+					hi[i] = v
+				}
+			}
+		}
+	}
+
+	dr = dr.Intersect(rgba.Bounds())
+	parallelRows(dr.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := rgba.Pix[rgba.PixOffset(dr.Min.X, dr.Min.Y+y):]
+			for i := 0; i < 4*dr.Dx(); i++ {
+				row[i] = uint8(clamp(int(row[i]), int(lo[i%4]), int(hi[i%4])))
+			}
+		}
+	})
+}
+
+// overlap returns the zero-based rectangle covered by both a and b once their
+// origins are aligned, so two-image loops never read outside either image
+func overlap(a, b image.Rectangle) image.Rectangle {
+	width, height := a.Dx(), a.Dy()
+	if b.Dx() < width {
+		width = b.Dx()
+	}
+	if b.Dy() < height {
+		height = b.Dy()
+	}
+	return image.Rect(0, 0, width, height)
+}
+
+// rowCheck is how many rows a worker processes between two ctx.Err() checks.
+// A chunk of rows costs far more than the check, while even 65536-pixel wide
+// images still notice a cancellation within a few milliseconds
+const rowCheck = 32
+
+// parallelRows splits the rows [0, height) into one band per GOMAXPROCS and
+// runs fn on every band concurrently, returning once all bands are done. Each
+// pixel is still computed exactly as in a serial loop, so the output does not
+// change with the number of bands
+func parallelRows(height int, fn func(y0, y1 int)) {
+	parallelRowsContext(context.Background(), height, fn)
+}
+
+// parallelRowsContext is parallelRows that stops handing rows to fn once ctx is
+// done. The result is then incomplete, so callers must check ctx.Err() afterwards
+func parallelRowsContext(ctx context.Context, height int, fn func(y0, y1 int)) {
+	// 每处理 rowCheck 行检查一次 ctx
+	fn = chunkRows(ctx, fn)
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > height {
+		workers = height
+	}
+	if workers <= 1 {
+		fn(0, height)
+		return
+	}
+
+	step := (height + workers - 1) / workers
+	var (
+		wg       sync.WaitGroup
+		panicked sync.Once
+		band     *BandPanic
+	)
+	for y0 := 0; y0 < height; y0 += step {
+		y1 := y0 + step
+		if y1 > height {
+			y1 = height
+		}
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			// 子 goroutine 里的 panic 没法被调用方 recover，先接住，等所有条带结束后在调用方重新抛出
+			defer func() {
+				if v := recover(); v != nil {
+					panicked.Do(func() { band = &BandPanic{Value: v, Stack: debug.Stack()} })
+				}
+			}()
+			fn(y0, y1)
+		}(y0, y1)
+	}
+	wg.Wait()
+	if band != nil {
+		panic(band)
+	}
+}
+
+// BandPanic is what a render panics with when code running on one of its worker
+// goroutines panicked, e.g. a custom Blend. It carries the original value and
+// the stack of the goroutine where the panic happened, which a recover in the
+// caller would otherwise lose
+type BandPanic struct {
+	Value any
+	Stack []byte
+}
+
+func (p *BandPanic) String() string {
+	return fmt.Sprint(p.Value)
+}
+
+// chunkRows wraps fn so that it works through its rows rowCheck at a time and
+// skips the remaining chunks once ctx is done
+func chunkRows(ctx context.Context, fn func(y0, y1 int)) func(y0, y1 int) {
+	return func(y0, y1 int) {
+		for y := y0; y < y1; y += rowCheck {
+			if ctx.Err() != nil {
+				return
+			}
+			end := y + rowCheck
+			if end > y1 {
+				end = y1
+			}
+			fn(y, end)
+		}
+	}
+}
+
+// Helper functions
+func max(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	} else if value > max {
+		return max
+	}
+	return value
+}
@@ -0,0 +1,153 @@
+package miragetank
+
+import (
+	"bytes"
+	"context"
+	"golang.org/x/image/draw"
+	"image"
+	"io"
+)
+
+// BuildWithOptions creates the 'mirage tank' image like Build, starting from
+// NewMirageTank with the Format matching targetName's extension and applying
+// opts in order, e.g.
+//
+//	BuildWithOptions("a.png", "b.png", "tank.png", WithShrink(0.5), WithRatios(0.4, -0.6))
+func BuildWithOptions(cover, hidden, targetName string, opts ...Option) error {
+	return BuildContext(context.Background(), cover, hidden, targetName, opts...)
+}
+
+// BuildContext is BuildWithOptions that gives up with ctx.Err() soon after ctx
+// is done, whether it is downloading a source, rendering or writing the tank.
+// Only decoding a source and resizing it run to completion once started
+func BuildContext(ctx context.Context, cover, hidden, targetName string, opts ...Option) error {
+	m := NewMirageTank()
+	m.Format = FormatFor(targetName)
+	for _, opt := range opts {
+		opt(m)
+	}
+	logger.Debug("start processing", "cover", cover, "hidden", hidden, "output", targetName)
+	imgA, imgB, err := openPair(ctx, cover, hidden)
+	if err != nil {
+		return err
+	}
+	tank, err := m.beforeEncode().RenderContext(ctx, imgA, imgB)
+	if err != nil {
+		return err
+	}
+	if err := m.writeFile(ctx, tank, targetName); err != nil {
+		return err
+	}
+	logger.Debug("finished", "output", targetName)
+	return nil
+}
+
+// BuildFrom creates the 'mirage tank' image from two encoded images and writes
+// it to out, like BuildTo but configured through opts. Nothing touches the
+// filesystem, so cover and hidden can be request bodies or embedded assets.
+// The output is a PNG unless an option sets the Format
+func BuildFrom(cover, hidden io.Reader, out io.Writer, opts ...Option) error {
+	return BuildFromContext(context.Background(), cover, hidden, out, opts...)
+}
+
+// BuildFromContext is BuildFrom that gives up with ctx.Err() soon after ctx is
+// done, like BuildContext
+func BuildFromContext(ctx context.Context, cover, hidden io.Reader, out io.Writer, opts ...Option) error {
+	imgA, imgB, err := DecodePair(cover, hidden)
+	if err != nil {
+		return err
+	}
+	m := NewMirageTank()
+	for _, opt := range opts {
+		opt(m)
+	}
+	tank, err := m.beforeEncode().RenderContext(ctx, imgA, imgB)
+	if err != nil {
+		return err
+	}
+	return m.EncodeContext(ctx, out, tank)
+}
+
+// WithShrink sets the output's scale relative to the cover, see MirageTank.Shrink
+func WithShrink(shrink float64) Option {
+	return func(m *MirageTank) { m.Shrink = shrink }
+}
+
+// WithRatios sets the lightness ratios of the cover and the hidden image,
+// see MirageTank.ForegroundRatio and MirageTank.BackgroundRatio
+func WithRatios(foreground, background float64) Option {
+	return func(m *MirageTank) { m.ForegroundRatio, m.BackgroundRatio = foreground, background }
+}
+
+// WithBlend replaces the blend and divide steps, see MirageTank.Blend and
+// MirageTank.Divide; nil keeps the built-in one
+func WithBlend(blend, divide GrayBlend) Option {
+	return func(m *MirageTank) { m.Blend, m.Divide = blend, divide }
+}
+
+// WithPipeline replaces the stages Render runs, see MirageTank.Pipeline
+func WithPipeline(p Pipeline) Option {
+	return func(m *MirageTank) { m.Pipeline = p }
+}
+
+// WithProgress sets the hook told about every completed stage, see MirageTank.OnProgress
+func WithProgress(fn func(stage string, pct float64)) Option {
+	return func(m *MirageTank) { m.OnProgress = fn }
+}
+
+// WithInterpolator sets the scaler used to resize the sources, see MirageTank.Interpolator
+func WithInterpolator(interp draw.Interpolator) Option {
+	return func(m *MirageTank) { m.Interpolator = interp }
+}
+
+// WithFormat sets the encoder of the output, overriding the one picked from
+// the file extension, see MirageTank.Format
+func WithFormat(format Format) Option {
+	return func(m *MirageTank) { m.Format = format }
+}
+
+// BuildImage creates the 'mirage tank' image of cover and hidden, which may be
+// files, http(s) URLs or Stdio, like BuildWithOptions but returns it instead of
+// writing it anywhere, e.g. to composite it further. Premultiplied is ignored
+func BuildImage(cover, hidden string, opts ...Option) (*image.NRGBA, error) {
+	m := NewMirageTank()
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.Premultiplied = false
+	return buildImage(context.Background(), m, cover, hidden)
+}
+
+// BuildPNG is BuildImage returning the tank encoded as a PNG, e.g. to upload it.
+// Format and Premultiplied are ignored
+func BuildPNG(cover, hidden string, opts ...Option) ([]byte, error) {
+	m := NewMirageTank()
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.Format, m.Premultiplied = PNG, false
+	tank, err := buildImage(context.Background(), m.beforeEncode(), cover, hidden)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := m.Encode(&buf, tank); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildImage decodes cover and hidden and renders them with m, which must not
+// be Premultiplied
+func buildImage(ctx context.Context, m *MirageTank, cover, hidden string) (*image.NRGBA, error) {
+	logger.Debug("start processing", "cover", cover, "hidden", hidden)
+	imgA, imgB, err := openPair(ctx, cover, hidden)
+	if err != nil {
+		return nil, err
+	}
+	tank, err := m.RenderContext(ctx, imgA, imgB)
+	if err != nil {
+		return nil, err
+	}
+	return tank.(*image.NRGBA), nil
+}
@@ -0,0 +1,88 @@
+package miragetank
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"testing"
+)
+
+// offset returns a copy of img whose bounds start at (7, 5), cut out of a
+// larger canvas with SubImage
+func offset(img image.Image) image.Image {
+	b := img.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, b.Dx()+10, b.Dy()+10))
+	r := image.Rect(7, 5, 7+b.Dx(), 5+b.Dy())
+	draw.Draw(canvas, r, img, b.Min, draw.Src)
+	return canvas.SubImage(r)
+}
+
+// TestNonZeroOrigin checks that sources whose bounds do not start at (0, 0)
+// render and blend like the same pixels starting at the origin
+func TestNonZeroOrigin(t *testing.T) {
+	cover, hidden := decodeNRGBA(t, "testdata/cover.png"), decodeNRGBA(t, "testdata/hidden.png")
+	grayA, grayB := Desaturate(cover), Desaturate(hidden)
+	offA, offB := offsetGray(grayA), offsetGray(grayB)
+
+	tests := []struct {
+		name      string
+		want, got func() (image.Image, error)
+	}{
+		{"Render",
+			func() (image.Image, error) { return NewMirageTank().Render(cover, hidden) },
+			func() (image.Image, error) { return NewMirageTank().Render(offset(cover), offset(hidden)) }},
+		{"Desaturate",
+			func() (image.Image, error) { return grayA, nil },
+			func() (image.Image, error) { return Desaturate(offset(cover)), nil }},
+		{"Invert",
+			func() (image.Image, error) { return Invert(grayA), nil },
+			func() (image.Image, error) { return Invert(offA), nil }},
+		{"LinearDodgeBlend",
+			func() (image.Image, error) { return LinearDodgeBlend(grayA, grayB), nil },
+			func() (image.Image, error) { return LinearDodgeBlend(offA, offB), nil }},
+		{"DivideBlend",
+			func() (image.Image, error) { return DivideBlend(grayA, grayB), nil },
+			func() (image.Image, error) { return DivideBlend(offA, offB), nil }},
+		{"AddMask",
+			func() (image.Image, error) { return AddMask(grayA, grayB), nil },
+			func() (image.Image, error) { return AddMask(offA, offB), nil }},
+	}
+	for _, tt := range tests {
+		want, err := tt.want()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tt.got()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Bounds().Size() != want.Bounds().Size() || !bytes.Equal(pix(got), pix(want)) {
+			t.Errorf("%s: offset sources give a different result", tt.name)
+		}
+	}
+}
+
+// offsetGray is offset for the gray layers the blends take
+func offsetGray(img *image.Gray) *image.Gray {
+	b := img.Bounds()
+	canvas := image.NewGray(image.Rect(0, 0, b.Dx()+10, b.Dy()+10))
+	r := image.Rect(7, 5, 7+b.Dx(), 5+b.Dy())
+	draw.Draw(canvas, r, img, b.Min, draw.Src)
+	return canvas.SubImage(r).(*image.Gray)
+}
+
+// pix returns the pixels of a *image.Gray or *image.NRGBA row by row, without
+// the stride padding a SubImage keeps
+func pix(img image.Image) []byte {
+	var out []byte
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		switch img := img.(type) {
+		case *image.Gray:
+			out = append(out, img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]...)
+		case *image.NRGBA:
+			out = append(out, img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+//go:build !js
+
+package miragetank
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// output is a destination opened by createOutput. Close commits what was
+// written, Abort throws it away
+type output struct {
+	io.Writer
+	// file is the temporary file renamed to name by Close; nil for standard output
+	file *os.File
+	name string
+}
+
+// createOutput opens name for writing, or standard output when name is "-".
+// A file is written to a temporary file next to it and only renamed into place
+// by Close, so a failed encode never leaves a truncated image at name
+func createOutput(name string) (*output, error) {
+	if name == Stdio {
+		return &output{Writer: os.Stdout}, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &output{Writer: f, file: f, name: name}, nil
+}
+
+// Close moves the finished file to its name; closing standard output is left to the process exit
+func (o *output) Close() error {
+	if o.file == nil {
+		return nil
+	}
+	// CreateTemp 只给所有者读写权限，改成和 os.WriteFile 常用的 0644 一致
+	if err := o.file.Chmod(0o644); err != nil {
+		o.Abort()
+		return err
+	}
+	if err := o.file.Close(); err != nil {
+		os.Remove(o.file.Name())
+		return err
+	}
+	if err := os.Rename(o.file.Name(), o.name); err != nil {
+		os.Remove(o.file.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort removes the temporary file, leaving whatever was at name untouched
+func (o *output) Abort() {
+	if o.file == nil {
+		return
+	}
+	o.file.Close()
+	os.Remove(o.file.Name())
+}
@@ -0,0 +1,34 @@
+package miragetank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errNoFiles is wrapped by every error the file, URL and standard stream entry
+// points return under js, where the package leaves out os and net/http. Decode
+// and encode through io.Reader, io.Writer or image.Image there instead
+var errNoFiles = fmt.Errorf("files, URLs and standard streams under js: %w", errors.ErrUnsupported)
+
+// output is the js stand-in for the file destination createOutput opens elsewhere
+type output struct {
+	io.Writer
+}
+
+// createOutput fails under js, see errNoFiles
+func createOutput(name string) (*output, error) {
+	return nil, fmt.Errorf("%s: %w", name, errNoFiles)
+}
+
+// Close does nothing; createOutput never returns an output under js
+func (o *output) Close() error { return nil }
+
+// Abort does nothing; createOutput never returns an output under js
+func (o *output) Abort() {}
+
+// openSource fails under js, see errNoFiles
+func openSource(ctx context.Context, name string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("%s: %w", name, errNoFiles)
+}
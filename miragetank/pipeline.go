@@ -0,0 +1,239 @@
+package miragetank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"time"
+)
+
+// Names of the stages in DefaultPipeline, in the order they run
+const (
+	StageDesaturate = "desaturate"
+	StageEnhance    = "enhance"
+	StageLightness  = "lightness"
+	StageInvert     = "invert"
+	StageBlend      = "blend"
+	StageMask       = "mask"
+)
+
+// errHighPrecisionPipeline is returned when HighPrecision or Dither is combined
+// with a custom Pipeline, whose stages only work on 8-bit images
+var errHighPrecisionPipeline = errors.New("HighPrecision and Dither do not support a custom Pipeline")
+
+// errNoTank is returned when a Pipeline finishes without setting Layers.Tank
+var errNoTank = errors.New("pipeline produced no tank")
+
+// Layers holds the images a Pipeline passes from stage to stage. Each stage
+// reads the fields the earlier ones filled in and replaces what it changes
+type Layers struct {
+	// Cover and Hidden are the two sources, fitted to the common canvas
+	Cover, Hidden image.Image
+	// CoverGray and HiddenGray are their gray layers, filled in by the
+	// desaturate stage and adjusted by the following ones
+	CoverGray, HiddenGray *image.Gray
+	// Alpha and Gray are the two channels of the tank, filled in by the blend stage
+	Alpha, Gray *image.Gray
+	// Tank is the finished tank, filled in by the mask stage
+	Tank *image.NRGBA
+}
+
+// Stage is one step of a Pipeline. Run reads the settings it needs from m,
+// which it must not modify
+type Stage struct {
+	Name string
+	Run  func(ctx context.Context, m *MirageTank, l *Layers) error
+}
+
+// Pipeline is the sequence of stages Render runs on the fitted sources, see
+// MirageTank.Pipeline. It is a plain slice, so stages can also be reordered
+// with the usual slice operations
+type Pipeline []Stage
+
+// DefaultPipeline returns the stages Render runs when MirageTank.Pipeline is
+// nil, each honoring the settings of the MirageTank that runs it:
+//
+//   - desaturate turns both sources gray by GrayMethod and applies Sharpen
+//   - enhance applies AutoContrast and EdgeEnhance to the hidden layer and
+//     Posterize to both
+//   - lightness scales both layers by their ratios and RatioMask
+//   - invert inverts the cover layer
+//   - blend combines the layers into Alpha and Gray with Blend and Divide,
+//     Gamma and DivideReduction
+//   - mask joins Gray and Alpha into Tank and applies AlphaBlur and MinAlpha
+func DefaultPipeline() Pipeline {
+	return append(Pipeline(nil), defaultPipeline...)
+}
+
+// defaultPipeline holds the stages DefaultPipeline hands out copies of
+var defaultPipeline = Pipeline{
+	{StageDesaturate, desaturateStage},
+	{StageEnhance, enhanceStage},
+	{StageLightness, lightnessStage},
+	{StageInvert, invertStage},
+	{StageBlend, blendStage},
+	{StageMask, maskStage},
+}
+
+// index returns the position of the stage called name in p, or -1
+func (p Pipeline) index(name string) int {
+	for i, s := range p {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Without returns a copy of p without the stages called names
+func (p Pipeline) Without(names ...string) Pipeline {
+	out := make(Pipeline, 0, len(p))
+	for _, s := range p {
+		skip := false
+		for _, name := range names {
+			skip = skip || s.Name == name
+		}
+		if !skip {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Replace returns a copy of p with the stage called name swapped for s.
+// p is returned unchanged when it has no such stage
+func (p Pipeline) Replace(name string, s Stage) Pipeline {
+	out := append(Pipeline(nil), p...)
+	if i := out.index(name); i >= 0 {
+		out[i] = s
+	}
+	return out
+}
+
+// InsertBefore returns a copy of p with s added in front of the stage called
+// name, or at the end when p has no such stage
+func (p Pipeline) InsertBefore(name string, s Stage) Pipeline {
+	i := p.index(name)
+	if i < 0 {
+		i = len(p)
+	}
+	return p.insert(i, s)
+}
+
+// InsertAfter returns a copy of p with s added behind the stage called name,
+// or at the end when p has no such stage
+func (p Pipeline) InsertAfter(name string, s Stage) Pipeline {
+	i := p.index(name)
+	if i < 0 {
+		i = len(p) - 1
+	}
+	return p.insert(i+1, s)
+}
+
+// insert returns a copy of p with s at position i
+func (p Pipeline) insert(i int, s Stage) Pipeline {
+	out := make(Pipeline, 0, len(p)+1)
+	out = append(out, p[:i]...)
+	out = append(out, s)
+	return append(out, p[i:]...)
+}
+
+// run runs the stages of p on l in order, stopping at the first error or once
+// ctx is done, and reports every completed stage to m's progress hooks
+func (p Pipeline) run(ctx context.Context, m *MirageTank, l *Layers) error {
+	for i, s := range p {
+		start := time.Now()
+		if err := s.Run(ctx, m, l); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		logger.Debug("stage done", "stage", s.Name, "took", time.Since(start))
+		m.progress(s.Name, i+1, len(p))
+	}
+	if l.Tank == nil {
+		return errNoTank
+	}
+	return nil
+}
+
+// desaturateStage is the StageDesaturate stage of DefaultPipeline
+func desaturateStage(ctx context.Context, m *MirageTank, l *Layers) error {
+	l.CoverGray = m.sharpen(ctx, desaturateMethod(ctx, l.Cover, m.GrayMethod))
+	l.HiddenGray = m.sharpen(ctx, desaturateMethod(ctx, l.Hidden, m.GrayMethod))
+	return nil
+}
+
+// enhanceStage is the StageEnhance stage of DefaultPipeline
+func enhanceStage(ctx context.Context, m *MirageTank, l *Layers) error {
+	if m.AutoContrast {
+		l.HiddenGray = autoContrast(ctx, l.HiddenGray, m.ClipLowPct, m.ClipHighPct)
+	}
+	if m.EdgeEnhance != 0 {
+		l.HiddenGray = edgeEnhance(ctx, l.HiddenGray, m.EdgeEnhance)
+	}
+	if m.Posterize >= 2 {
+		l.CoverGray, l.HiddenGray = posterize(ctx, l.CoverGray, m.Posterize), posterize(ctx, l.HiddenGray, m.Posterize)
+	}
+	m.dump(debugGrayA, l.CoverGray)
+	m.dump(debugGrayB, l.HiddenGray)
+	return nil
+}
+
+// lightnessStage is the StageLightness stage of DefaultPipeline
+func lightnessStage(ctx context.Context, m *MirageTank, l *Layers) error {
+	mask := m.ratioMask(l.CoverGray.Bounds())
+	l.CoverGray = adjustLightnessMasked(ctx, l.CoverGray, m.ForegroundRatio, mask)
+	l.HiddenGray = adjustLightnessMasked(ctx, l.HiddenGray, m.BackgroundRatio, mask)
+	m.dump(debugAdjustedB, l.HiddenGray)
+	return nil
+}
+
+// invertStage is the StageInvert stage of DefaultPipeline
+func invertStage(ctx context.Context, m *MirageTank, l *Layers) error {
+	l.CoverGray = invert(ctx, l.CoverGray)
+	m.dump(debugAdjustedA, l.CoverGray)
+	return nil
+}
+
+// blendStage is the StageBlend stage of DefaultPipeline
+func blendStage(ctx context.Context, m *MirageTank, l *Layers) error {
+	grayA, grayB := l.CoverGray, l.HiddenGray
+	if grayA.Bounds().Size() != grayB.Bounds().Size() {
+		return fmt.Errorf("%w: %v vs %v", ErrBoundsMismatch, grayA.Bounds(), grayB.Bounds())
+	}
+	useGamma := m.Gamma != 0 && m.Gamma != 1
+	if useGamma {
+		// 转到线性空间再混合，混合后把颜色通道转回 sRGB
+		grayA, grayB = gamma(ctx, grayA, m.Gamma), gamma(ctx, grayB, m.Gamma)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	blend, divide := m.blends(ctx)
+	linearDodge := blend(grayA, grayB)
+	divided := divide(linearDodge, grayB)
+	if t := m.divideStrength(); t != 1 {
+		divided = mixBlend(ctx, divided, linearDodge, t)
+	}
+	if useGamma {
+		divided = gamma(ctx, divided, 1/m.Gamma)
+	}
+	l.Alpha, l.Gray = linearDodge, divided
+	m.dump(debugLinearDodge, linearDodge)
+	m.dump(debugDivided, divided)
+	return nil
+}
+
+// maskStage is the StageMask stage of DefaultPipeline
+func maskStage(ctx context.Context, m *MirageTank, l *Layers) error {
+	l.Tank = m.finish(ctx, addMask(ctx, l.Gray, l.Alpha))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.dump(debugFinal, l.Tank)
+	return nil
+}
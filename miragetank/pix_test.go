@@ -0,0 +1,88 @@
+package miragetank
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// TestPixMatchesAtSet checks the Pix-indexing loops of Desaturate,
+// LinearDodgeBlend, DivideBlend and AddMask against straightforward At/Set
+// implementations of the same formulas on the testdata pair
+func TestPixMatchesAtSet(t *testing.T) {
+	toRGBA := func(img image.Image) *image.RGBA {
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		return rgba
+	}
+	cover := toRGBA(decodeNRGBA(t, "testdata/cover.png"))
+	hidden := toRGBA(decodeNRGBA(t, "testdata/hidden.png"))
+	bounds := cover.Bounds()
+
+	// 参考实现：逐像素 At/Set
+	desaturate := func(img image.Image) *image.Gray {
+		out := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				r, g, b := uint32(c.R), uint32(c.G), uint32(c.B)
+				out.Set(x, y, color.Gray{Y: uint8((max(max(r, g), b) + min(min(r, g), b) + 1) / 2)})
+			}
+		}
+		return out
+	}
+	blend := func(a, b *image.Gray, fn func(x, y int) int) *image.Gray {
+		out := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				out.Set(x, y, color.Gray{Y: uint8(fn(int(a.GrayAt(x, y).Y), int(b.GrayAt(x, y).Y)))})
+			}
+		}
+		return out
+	}
+	linearDodge := func(x, y int) int { return clamp(x+y, 0, 255) }
+	divide := func(x, y int) int {
+		if x == 0 {
+			return 255
+		}
+		return clamp((y*255+x/2)/x, 0, 255)
+	}
+
+	grayA, grayB := desaturate(cover), desaturate(hidden)
+	if got := Desaturate(cover); !equalGray(got, grayA) {
+		t.Error("Desaturate differs from the At/Set reference")
+	}
+	dodged := blend(grayA, grayB, linearDodge)
+	if got := LinearDodgeBlend(grayA, grayB); !equalGray(got, dodged) {
+		t.Error("LinearDodgeBlend differs from the At/Set reference")
+	}
+	divided := blend(dodged, grayB, divide)
+	if got := DivideBlend(dodged, grayB); !equalGray(got, divided) {
+		t.Error("DivideBlend differs from the At/Set reference")
+	}
+	tank := AddMask(divided, dodged)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			g, a := divided.GrayAt(x, y).Y, dodged.GrayAt(x, y).Y
+			if got, want := tank.NRGBAAt(x, y), (color.NRGBA{R: g, G: g, B: g, A: a}); got != want {
+				t.Fatalf("AddMask pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// equalGray reports whether two gray images have the same bounds and pixels
+func equalGray(a, b *image.Gray) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Rect.Min.Y; y < a.Rect.Max.Y; y++ {
+		for x := a.Rect.Min.X; x < a.Rect.Max.X; x++ {
+			if a.GrayAt(x, y) != b.GrayAt(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
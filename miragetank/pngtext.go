@@ -0,0 +1,98 @@
+package miragetank
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// EncodePNGComment writes img to w as a PNG carrying comment in a text chunk
+// with the "Comment" keyword. Latin-1 text goes into a tEXt chunk and anything
+// else into an uncompressed UTF-8 iTXt chunk. An empty comment writes a plain
+// PNG, which png.Encode already keeps free of any metadata
+func EncodePNGComment(w io.Writer, img image.Image, comment string) error {
+	return encodePNG(w, img, comment, png.DefaultCompression)
+}
+
+// encodePNG is EncodePNGComment compressing the image data at level
+func encodePNG(w io.Writer, img image.Image, comment string, level png.CompressionLevel) error {
+	enc := &png.Encoder{CompressionLevel: level}
+	if comment == "" {
+		return enc.Encode(w, img)
+	}
+	if !utf8.ValidString(comment) || strings.ContainsRune(comment, 0) {
+		return errors.New("png comment must be UTF-8 without NUL bytes")
+	}
+
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, img); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	// png 编码器总是先写签名和 IHDR（13 字节数据 + 12 字节长度/类型/CRC），文本块插在 IHDR 之后
+	ihdrEnd := len(pngSignature) + 12 + 13
+	if _, err := w.Write(data[:ihdrEnd]); err != nil {
+		return err
+	}
+	if err := writeTextChunk(w, "Comment", comment); err != nil {
+		return err
+	}
+	_, err := w.Write(data[ihdrEnd:])
+	return err
+}
+
+// writeTextChunk writes keyword and text as a tEXt chunk, or as an iTXt chunk
+// when text cannot be represented in Latin-1
+func writeTextChunk(w io.Writer, keyword, text string) error {
+	chunkType, payload := "tEXt", []byte(keyword+"\x00")
+	if latin1, ok := toLatin1(text); ok {
+		payload = append(payload, latin1...)
+	} else {
+		// iTXt：不压缩，语言标签和翻译后的关键字留空
+		chunkType = "iTXt"
+		payload = append(payload, 0, 0, 0, 0)
+		payload = append(payload, text...)
+	}
+	return writeChunk(w, chunkType, payload)
+}
+
+// writeChunk writes one PNG chunk: length, type, payload and CRC
+func writeChunk(w io.Writer, chunkType string, payload []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	copy(header[4:], chunkType)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(payload)
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+	for _, part := range [][]byte{header[:], payload, footer[:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toLatin1 converts text to ISO 8859-1, reporting false if some rune does not fit
+func toLatin1(text string) ([]byte, bool) {
+	out := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r > 0xff {
+			return nil, false
+		}
+		out = append(out, byte(r))
+	}
+	return out, true
+}
@@ -0,0 +1,332 @@
+package miragetank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// errHighPrecisionBlend is returned when HighPrecision or Dither is combined with
+// custom blends, which only exist for 8-bit images
+var errHighPrecisionBlend = errors.New("HighPrecision and Dither do not support custom Blend or Divide functions")
+
+// renderHighPrecision is RenderContext for m.HighPrecision and m.Dither: the same
+// stages run on image.Gray16, and only the final mask rounds the result to 8 bits
+func (m *MirageTank) renderHighPrecision(ctx context.Context, imgA, imgB image.Image) (image.Image, error) {
+	if m.Blend != nil || m.Divide != nil {
+		return nil, errHighPrecisionBlend
+	}
+	if m.Pipeline != nil {
+		return nil, errHighPrecisionPipeline
+	}
+	m.dump(debugResizedA, imgA)
+	m.dump(debugResizedB, imgB)
+
+	grayA := m.sharpen16(ctx, desaturate16(ctx, imgA, m.GrayMethod))
+	grayB := m.sharpen16(ctx, desaturate16(ctx, imgB, m.GrayMethod))
+	m.progressDefault(StageDesaturate)
+	if m.AutoContrast {
+		grayB = autoContrast16(ctx, grayB, m.ClipLowPct, m.ClipHighPct)
+	}
+	if m.EdgeEnhance != 0 {
+		grayB = edgeEnhance16(ctx, grayB, m.EdgeEnhance)
+	}
+	if m.Posterize >= 2 {
+		grayA, grayB = posterize16(ctx, grayA, m.Posterize), posterize16(ctx, grayB, m.Posterize)
+	}
+	m.progressDefault(StageEnhance)
+	m.dump(debugGrayA, grayA)
+	m.dump(debugGrayB, grayB)
+
+	mask := m.ratioMask(grayA.Bounds())
+	grayA = adjustLightness16(ctx, grayA, m.ForegroundRatio, mask)
+	grayB = adjustLightness16(ctx, grayB, m.BackgroundRatio, mask)
+	m.progressDefault(StageLightness)
+	grayA = invert16(ctx, grayA)
+	m.progressDefault(StageInvert)
+	m.dump(debugAdjustedA, grayA)
+	m.dump(debugAdjustedB, grayB)
+	if grayA.Bounds().Size() != grayB.Bounds().Size() {
+		return nil, fmt.Errorf("%w: %v vs %v", ErrBoundsMismatch, grayA.Bounds(), grayB.Bounds())
+	}
+
+	useGamma := m.Gamma != 0 && m.Gamma != 1
+	if useGamma {
+		grayA, grayB = gamma16(ctx, grayA, m.Gamma), gamma16(ctx, grayB, m.Gamma)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	linearDodge := linearDodgeBlend16(ctx, grayA, grayB)
+	divided := divideBlend16(ctx, linearDodge, grayB)
+	if t := m.divideStrength(); t != 1 {
+		divided = blendPixels16(ctx, divided, linearDodge, func(x, y uint16) uint16 {
+			return uint16(clamp(int(t*float64(x)+(1-t)*float64(y)+0.5), 0, 65535))
+		})
+	}
+	if useGamma {
+		divided = gamma16(ctx, divided, 1/m.Gamma)
+	}
+	m.progressDefault(StageBlend)
+	m.dump(debugLinearDodge, linearDodge)
+	m.dump(debugDivided, divided)
+
+	// 分块渲染时条带从 y0 行开始，按画布坐标抖动，条带之间的图案才能接上
+	result := m.finish(ctx, addMask16(ctx, divided, linearDodge, m.Dither, imgA.Bounds().Min))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.dump(debugFinal, result)
+	m.progressDefault(StageMask)
+	return result, nil
+}
+
+// sharpen16 is MirageTank.sharpen for 16-bit grayscale images
+func (m *MirageTank) sharpen16(ctx context.Context, img *image.Gray16) *image.Gray16 {
+	if m.Sharpen == 0 {
+		return img
+	}
+	return unsharpMask16(ctx, img, m.sharpenRadius(), m.Sharpen)
+}
+
+// LinearDodgeBlend16 is LinearDodgeBlend for 16-bit grayscale images
+func LinearDodgeBlend16(imgX, imgY *image.Gray16) *image.Gray16 {
+	return linearDodgeBlend16(context.Background(), imgX, imgY)
+}
+
+// DivideBlend16 is DivideBlend for 16-bit grayscale images
+func DivideBlend16(imgX, imgY *image.Gray16) *image.Gray16 {
+	return divideBlend16(context.Background(), imgX, imgY)
+}
+
+// AddMask16 is AddMask for 16-bit grayscale images, rounding both channels
+// to the 8 bits of the returned image
+func AddMask16(imgX, imgY *image.Gray16) *image.NRGBA {
+	return addMask16(context.Background(), imgX, imgY, NoDither, image.Point{})
+}
+
+// desaturate16 is desaturateMethod keeping 16 bits per pixel
+func desaturate16(ctx context.Context, img image.Image, method GrayMethod) *image.Gray16 {
+	bounds := img.Bounds()
+	grayImg := image.NewGray16(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	toGray := grayFunc16(method)
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			out := grayImg.Pix[grayImg.PixOffset(0, y):]
+			for x := 0; x < bounds.Dx(); x++ {
+				r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				put16(out, x, toGray(r, g, b))
+			}
+		}
+	})
+	return grayImg
+}
+
+// grayFunc16 is grayFunc for channels in the 0-65535 range
+func grayFunc16(method GrayMethod) func(r, g, b uint32) uint16 {
+	switch method {
+	case Luminosity:
+		return func(r, g, b uint32) uint16 {
+			return uint16((299*r + 587*g + 114*b + 500) / 1000)
+		}
+	case Average:
+		return func(r, g, b uint32) uint16 {
+			return uint16((r + g + b + 1) / 3)
+		}
+	case LinearLuminance:
+		return linearLuminance16
+	default:
+		return func(r, g, b uint32) uint16 {
+			return uint16((max(max(r, g), b) + min(min(r, g), b) + 1) / 2)
+		}
+	}
+}
+
+// adjustLightness16 is adjustLightnessMasked for 16-bit grayscale images
+func adjustLightness16(ctx context.Context, img *image.Gray16, ratio float64, mask *image.Gray) *image.Gray16 {
+	bounds := img.Bounds()
+	result := image.NewGray16(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < bounds.Dx(); x++ {
+				ratio := ratio
+				if mask != nil {
+					ratio *= float64(mask.Pix[mask.PixOffset(mask.Rect.Min.X+x, mask.Rect.Min.Y+y)]) / 255
+				}
+				var newGray float64
+				if ratio > 0 {
+					newGray = float64(get16(row, x))*(1-ratio) + 65535*ratio
+				} else {
+					newGray = float64(get16(row, x)) * (1 + ratio)
+				}
+				put16(out, x, uint16(clamp(int(newGray+0.5), 0, 65535)))
+			}
+		}
+	})
+	return result
+}
+
+// invert16 is invert for 16-bit grayscale images
+func invert16(ctx context.Context, img *image.Gray16) *image.Gray16 {
+	return mapGray16(ctx, img, func(gray uint16) uint16 { return 65535 - gray })
+}
+
+// gamma16 is gamma for 16-bit grayscale images
+func gamma16(ctx context.Context, img *image.Gray16, g float64) *image.Gray16 {
+	table := make([]uint16, 1<<16)
+	for i := range table {
+		table[i] = uint16(clamp(int(65535*math.Pow(float64(i)/65535, g)+0.5), 0, 65535))
+	}
+	return mapGray16(ctx, img, func(gray uint16) uint16 { return table[gray] })
+}
+
+// autoContrast16 is autoContrast for 16-bit grayscale images
+func autoContrast16(ctx context.Context, img *image.Gray16, clipLowPct, clipHighPct float64) *image.Gray16 {
+	bounds := img.Bounds()
+	histogram := make([]int, 1<<16)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			histogram[get16(row, x)]++
+		}
+	}
+
+	low, high := clipRange(histogram, clipLowPct, clipHighPct)
+	if high <= low {
+		return mapGray16(ctx, img, func(gray uint16) uint16 { return gray })
+	}
+	return mapGray16(ctx, img, func(gray uint16) uint16 {
+		return uint16(clamp((65535*(int(gray)-low)+(high-low)/2)/(high-low), 0, 65535))
+	})
+}
+
+// linearDodgeBlend16 implements LinearDodgeBlend16, giving up early once ctx is done
+func linearDodgeBlend16(ctx context.Context, imgX, imgY *image.Gray16) *image.Gray16 {
+	return blendPixels16(ctx, imgX, imgY, func(x, y uint16) uint16 {
+		return uint16(clamp(int(x)+int(y), 0, 65535))
+	})
+}
+
+// divideBlend16 implements DivideBlend16, giving up early once ctx is done
+func divideBlend16(ctx context.Context, imgX, imgY *image.Gray16) *image.Gray16 {
+	return blendPixels16(ctx, imgX, imgY, func(x, y uint16) uint16 {
+		if x == 0 {
+			return 65535
+		}
+		return uint16(clamp((int(y)*65535+int(x)/2)/int(x), 0, 65535))
+	})
+}
+
+// addMask16 implements AddMask16, giving up early once ctx is done.
+// dither picks the channels rounded with ditherTo8 instead of to8, whose
+// pattern starts at origin, the canvas position of the first pixel
+func addMask16(ctx context.Context, imgX, imgY *image.Gray16, dither Dither, origin image.Point) *image.NRGBA {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	result := image.NewNRGBA(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+			rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < size.Dx(); x++ {
+				gray, alpha := to8(get16(rowX, x)), to8(get16(rowY, x))
+				if dither != NoDither {
+					alpha = ditherTo8(get16(rowY, x), origin.X+x, origin.Y+y)
+				}
+				if dither == DitherAll {
+					gray = ditherTo8(get16(rowX, x), origin.X+x, origin.Y+y)
+				}
+				out[4*x], out[4*x+1], out[4*x+2], out[4*x+3] = gray, gray, gray, alpha
+			}
+		}
+	})
+	return result
+}
+
+// posterize16 is posterize for 16-bit grayscale images
+func posterize16(ctx context.Context, img *image.Gray16, levels int) *image.Gray16 {
+	return mapGray16(ctx, img, func(gray uint16) uint16 {
+		return uint16(quantize(int(gray), 65535, levels))
+	})
+}
+
+// mapGray16 applies fn to every pixel of a 16-bit grayscale image
+func mapGray16(ctx context.Context, img *image.Gray16, fn func(gray uint16) uint16) *image.Gray16 {
+	bounds := img.Bounds()
+	result := image.NewGray16(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < bounds.Dx(); x++ {
+				put16(out, x, fn(get16(row, x)))
+			}
+		}
+	})
+	return result
+}
+
+// blendPixels16 is blendPixels for 16-bit grayscale images
+func blendPixels16(ctx context.Context, imgX, imgY *image.Gray16, fn func(x, y uint16) uint16) *image.Gray16 {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	result := image.NewGray16(size)
+
+	parallelRowsContext(ctx, size.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+			rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+			out := result.Pix[result.PixOffset(0, y):]
+			for x := 0; x < size.Dx(); x++ {
+				put16(out, x, fn(get16(rowX, x), get16(rowY, x)))
+			}
+		}
+	})
+	return result
+}
+
+// get16 reads the x-th big-endian pixel of a Gray16 row
+func get16(row []uint8, x int) uint16 {
+	return uint16(row[2*x])<<8 | uint16(row[2*x+1])
+}
+
+// put16 writes the x-th big-endian pixel of a Gray16 row
+func put16(row []uint8, x int, v uint16) {
+	row[2*x], row[2*x+1] = uint8(v>>8), uint8(v)
+}
+
+// to8 rounds a 16-bit value to the nearest 8-bit one
+func to8(v uint16) uint8 {
+	return uint8((uint32(v)*255 + 32767) / 65535)
+}
+
+// bayer8 is the 8x8 Bayer matrix ordering the dither thresholds
+var bayer8 = [8][8]uint8{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// ditherTo8 is to8 with an ordered dither: the fraction lost by rounding v at
+// pixel x, y is compared with that pixel's Bayer threshold, so over every 8x8
+// block the 8-bit values average out to v
+func ditherTo8(v uint16, x, y int) uint8 {
+	// 阈值取 (2b+1)/128，平均为 1/2，整体上与四舍五入一致
+	threshold := (2*uint32(bayer8[y&7][x&7]) + 1) * 65535 / 128
+	return uint8((uint32(v)*255 + threshold) / 65535)
+}
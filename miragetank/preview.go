@@ -0,0 +1,115 @@
+package miragetank
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Preview composites the tank over solid white and solid black backgrounds,
+// showing what viewers will see in each state
+func Preview(tank *image.NRGBA) (onWhite, onBlack *image.RGBA) {
+	return CompositeOver(tank, color.White), CompositeOver(tank, color.Black)
+}
+
+// CompositeOver draws img over a solid bg using src-over alpha compositing,
+// e.g. to see whether the hidden image leaks on a chat app's gray background
+func CompositeOver(img image.Image, bg color.Color) *image.RGBA {
+	bounds := img.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(result, result.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(result, result.Bounds(), img, bounds.Min, draw.Over)
+	return result
+}
+
+// SideBySide places left and right next to each other on one canvas
+func SideBySide(left, right image.Image) *image.RGBA {
+	lb, rb := left.Bounds(), right.Bounds()
+	height := lb.Dy()
+	if rb.Dy() > height {
+		height = rb.Dy()
+	}
+	result := image.NewRGBA(image.Rect(0, 0, lb.Dx()+rb.Dx(), height))
+	draw.Draw(result, image.Rect(0, 0, lb.Dx(), lb.Dy()), left, lb.Min, draw.Src)
+	draw.Draw(result, image.Rect(lb.Dx(), 0, lb.Dx()+rb.Dx(), rb.Dy()), right, rb.Min, draw.Src)
+	return result
+}
+
+// compareDivider is the width in pixels of the gray line Compare draws between the halves
+const compareDivider = 2
+
+// Compare shows the tank on white next to the tank on black in one image,
+// separated by a thin gray divider, so both states can be checked at a glance
+func Compare(tank image.Image) *image.RGBA {
+	onWhite, onBlack := CompositeOver(tank, color.White), CompositeOver(tank, color.Black)
+	width, height := onWhite.Bounds().Dx(), onWhite.Bounds().Dy()
+	result := image.NewRGBA(image.Rect(0, 0, 2*width+compareDivider, height))
+	draw.Draw(result, image.Rect(0, 0, width, height), onWhite, image.Point{}, draw.Src)
+	draw.Draw(result, image.Rect(width, 0, width+compareDivider, height), image.NewUniform(color.Gray{Y: 128}), image.Point{}, draw.Src)
+	draw.Draw(result, image.Rect(width+compareDivider, 0, 2*width+compareDivider, height), onBlack, image.Point{}, draw.Src)
+	return result
+}
+
+// LeakBackground finds the lightest gray background on which the hidden image
+// already shows; every darker gray leaks too. Compositing is linear in the background, so the hidden image is
+// always most visible on black and fades as the background lightens; the
+// worst case worth knowing is the lightest gray on which the composite already
+// looks more like the hidden image than like the cover, judged by SSIM against
+// ExtractHidden and ExtractCover. It returns that gray and the tank composited
+// over it, or 0 and the tank over black when the cover wins on every gray but black
+func LeakBackground(tank image.Image) (gray uint8, composite *image.RGBA) {
+	cover, hidden := ExtractCover(tank), ExtractHidden(tank)
+	leaks := func(g int) bool {
+		onGray := Desaturate(CompositeOver(tank, color.Gray{Y: uint8(g)}))
+		return SSIM(onGray, hidden) >= SSIM(onGray, cover)
+	}
+
+	// 背景越暗里图越明显，二分查找里图刚好压过表图的最亮灰度
+	lo, hi := 0, 256
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if leaks(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	gray = uint8(lo)
+	return gray, CompositeOver(tank, color.Gray{Y: gray})
+}
+
+// ExtractHidden recovers the hidden image from a finished tank: the gray a
+// viewer sees on black, which is the tank's color premultiplied by its alpha.
+// Rounding in the divide step makes it approximate where alpha is small
+func ExtractHidden(tank image.Image) *image.Gray {
+	return extractGray(tank, false)
+}
+
+// ExtractCover recovers the cover image from a finished tank, i.e. the gray
+// a viewer sees on white. Both recovered images still carry the lightness
+// adjustment the tank was built with
+func ExtractCover(tank image.Image) *image.Gray {
+	return extractGray(tank, true)
+}
+
+// extractGray composites tank over black, or over white if onWhite is set, and
+// averages the channels into gray
+func extractGray(tank image.Image, onWhite bool) *image.Gray {
+	bounds := tank.Bounds()
+	result := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				// RGBA 返回的是预乘过 alpha 的值，正好是黑底上看到的颜色
+				r, g, b, a := tank.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				gray := (r + g + b + 1) / 3
+				if onWhite {
+					gray += 0xffff - a
+				}
+				result.Pix[result.PixOffset(x, y)] = uint8((gray*255 + 0x7fff) / 0xffff)
+			}
+		}
+	})
+	return result
+}
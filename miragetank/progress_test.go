@@ -0,0 +1,60 @@
+package miragetank
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestProgressReachesOne checks that every entry point reports rising
+// fractions that end at exactly 1, whether or not it encodes the tank
+func TestProgressReachesOne(t *testing.T) {
+	cover, hidden := decodeNRGBA(t, "testdata/cover.png"), decodeNRGBA(t, "testdata/hidden.png")
+	tests := map[string]func(progress func(float64)) error{
+		"Render": func(progress func(float64)) error {
+			m := NewMirageTank()
+			m.Progress = progress
+			_, err := m.Render(cover, hidden)
+			return err
+		},
+		"HighPrecision": func(progress func(float64)) error {
+			m := NewMirageTank()
+			m.Progress, m.HighPrecision = progress, true
+			_, err := m.Render(cover, hidden)
+			return err
+		},
+		"RenderColor": func(progress func(float64)) error {
+			m := NewMirageTank()
+			m.Progress = progress
+			_, err := m.RenderColor(cover, hidden)
+			return err
+		},
+		"BuildImage": func(progress func(float64)) error {
+			_, err := BuildImage("testdata/cover.png", "testdata/hidden.png", func(m *MirageTank) { m.Progress = progress })
+			return err
+		},
+		"BuildPNG": func(progress func(float64)) error {
+			_, err := BuildPNG("testdata/cover.png", "testdata/hidden.png", func(m *MirageTank) { m.Progress = progress })
+			return err
+		},
+		"BuildBoth": func(progress func(float64)) error {
+			m := NewMirageTank()
+			m.Progress = progress
+			return m.BuildBoth("testdata/cover.png", "testdata/hidden.png", filepath.Join(t.TempDir(), "tank.png"))
+		},
+	}
+	for name, run := range tests {
+		var got []float64
+		if err := run(func(f float64) { got = append(got, f) }); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i] <= got[i-1] {
+				t.Errorf("%s: progress %v does not rise", name, got)
+				break
+			}
+		}
+		if len(got) == 0 || got[len(got)-1] != 1 {
+			t.Errorf("%s: progress %v does not end at 1", name, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package miragetank
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+)
+
+// ssimWindow and ssimStride are the size and the step of the square windows SSIM averages over
+const (
+	ssimWindow = 8
+	ssimStride = 4
+)
+
+// Quality is how faithfully a tank shows its sources, see MirageTank.Measure
+type Quality struct {
+	// CoverPSNR and CoverSSIM compare the tank over white with the cover
+	CoverPSNR, CoverSSIM float64
+	// HiddenPSNR and HiddenSSIM compare the tank over black with the hidden image
+	HiddenPSNR, HiddenSSIM float64
+}
+
+// Measure composites tank, rendered by m from cover and hidden, over white and
+// over black and scores both states against the sources resized and
+// desaturated like Render does. The lightness ratios alone keep the scores
+// from reaching a perfect match, so compare them between settings or pairs
+// rather than against fixed values
+func (m *MirageTank) Measure(cover, hidden, tank image.Image) (Quality, error) {
+	if err := checkSources(cover, hidden); err != nil {
+		return Quality{}, err
+	}
+	ctx := context.Background()
+	imgA, imgB := m.fit(cover, hidden)
+	wantCover, wantHidden := desaturateMethod(ctx, imgA, m.GrayMethod), desaturateMethod(ctx, imgB, m.GrayMethod)
+	onWhite := desaturateMethod(ctx, CompositeOver(tank, color.White), m.GrayMethod)
+	onBlack := desaturateMethod(ctx, CompositeOver(tank, color.Black), m.GrayMethod)
+
+	return Quality{
+		CoverPSNR:  PSNR(onWhite, wantCover),
+		CoverSSIM:  SSIM(onWhite, wantCover),
+		HiddenPSNR: PSNR(onBlack, wantHidden),
+		HiddenSSIM: SSIM(onBlack, wantHidden),
+	}, nil
+}
+
+// PSNR returns the peak signal-to-noise ratio of two grayscale images over
+// their overlap in decibels, +Inf when they are identical
+func PSNR(imgX, imgY *image.Gray) float64 {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	if size.Empty() {
+		return math.Inf(1)
+	}
+
+	var sum float64
+	for y := 0; y < size.Dy(); y++ {
+		rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+		rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+		for x := 0; x < size.Dx(); x++ {
+			d := float64(rowX[x]) - float64(rowY[x])
+			sum += d * d
+		}
+	}
+	mse := sum / float64(size.Dx()*size.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// SSIM returns the structural similarity of two grayscale images over their
+// overlap, from about 0 for unrelated images to 1 for identical ones. It
+// averages the SSIM of 8x8 windows taken every 4 pixels; an image smaller than
+// a window is scored as a whole
+func SSIM(imgX, imgY *image.Gray) float64 {
+	boundsX, boundsY := imgX.Bounds(), imgY.Bounds()
+	size := overlap(boundsX, boundsY)
+	if size.Empty() {
+		return 1
+	}
+
+	windowW, windowH := ssimWindow, ssimWindow
+	if size.Dx() < windowW {
+		windowW = size.Dx()
+	}
+	if size.Dy() < windowH {
+		windowH = size.Dy()
+	}
+	var sum float64
+	var windows int
+	for y0 := 0; y0+windowH <= size.Dy(); y0 += ssimStride {
+		for x0 := 0; x0+windowW <= size.Dx(); x0 += ssimStride {
+			// 窗口内的均值、方差和协方差
+			var sx, sy, sxx, syy, sxy float64
+			for y := y0; y < y0+windowH; y++ {
+				rowX := imgX.Pix[imgX.PixOffset(boundsX.Min.X, boundsX.Min.Y+y):]
+				rowY := imgY.Pix[imgY.PixOffset(boundsY.Min.X, boundsY.Min.Y+y):]
+				for x := x0; x < x0+windowW; x++ {
+					vx, vy := float64(rowX[x]), float64(rowY[x])
+					sx, sy = sx+vx, sy+vy
+					sxx, syy, sxy = sxx+vx*vx, syy+vy*vy, sxy+vx*vy
+				}
+			}
+			n := float64(windowW * windowH)
+			mx, my := sx/n, sy/n
+			vx, vy, cov := sxx/n-mx*mx, syy/n-my*my, sxy/n-mx*my
+
+			const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+			sum += (2*mx*my + c1) * (2*cov + c2) / ((mx*mx + my*my + c1) * (vx + vy + c2))
+			windows++
+		}
+	}
+	return sum / float64(windows)
+}
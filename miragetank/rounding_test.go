@@ -0,0 +1,44 @@
+package miragetank
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// uniformGray returns a 4x4 image filled with v
+func uniformGray(v uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = v
+	}
+	return img
+}
+
+// TestMidGrayRoundTrip renders uniform mid-gray pairs with the default ratios
+// and checks the tank shows the rounded, not the truncated, lightness-adjusted
+// grays on white and on black
+func TestMidGrayRoundTrip(t *testing.T) {
+	tests := []struct {
+		cover, hidden    uint8
+		onWhite, onBlack uint8
+	}{
+		// 128*0.5+127.5 = 191.5，向下截断会得到 191
+		{128, 128, 192, 64},
+		{127, 129, 191, 65},
+		{101, 77, 178, 39},
+	}
+	for _, tt := range tests {
+		tank, err := NewMirageTank().Render(uniformGray(tt.cover), uniformGray(tt.hidden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		onWhite, onBlack := Preview(tank.(*image.NRGBA))
+		if got := color.GrayModel.Convert(onWhite.At(1, 1)).(color.Gray).Y; got != tt.onWhite {
+			t.Errorf("cover %d: on white got %d, want %d", tt.cover, got, tt.onWhite)
+		}
+		if got := color.GrayModel.Convert(onBlack.At(1, 1)).(color.Gray).Y; got != tt.onBlack {
+			t.Errorf("hidden %d: on black got %d, want %d", tt.hidden, got, tt.onBlack)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package miragetank
+
+import (
+	"context"
+	"image"
+	"math"
+)
+
+// UnsharpMask sharpens a grayscale image by adding back amount times the
+// difference between the image and a Gaussian blur of it. radius is the
+// standard deviation of the blur in pixels; an amount of 1 doubles the local
+// contrast of details smaller than about radius
+func UnsharpMask(img *image.Gray, radius, amount float64) *image.Gray {
+	return unsharpMask(context.Background(), img, radius, amount)
+}
+
+// unsharpMask implements UnsharpMask, giving up early once ctx is done
+func unsharpMask(ctx context.Context, img *image.Gray, radius, amount float64) *image.Gray {
+	bounds := img.Bounds()
+	plane := make([]float32, bounds.Dx()*bounds.Dy())
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			plane[y*bounds.Dx()+x] = float32(row[x])
+		}
+	}
+
+	sharpened := sharpenPlane(ctx, plane, bounds.Dx(), bounds.Dy(), radius, amount)
+	result := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for i, v := range sharpened {
+		result.Pix[i] = uint8(clamp(int(v+0.5), 0, 255))
+	}
+	return result
+}
+
+// unsharpMask16 is unsharpMask for 16-bit grayscale images
+func unsharpMask16(ctx context.Context, img *image.Gray16, radius, amount float64) *image.Gray16 {
+	return fromPlane16(sharpenPlane(ctx, toPlane16(img), img.Bounds().Dx(), img.Bounds().Dy(), radius, amount), img.Bounds())
+}
+
+// EdgeEnhance brightens the edges of a grayscale image by adding strength
+// times their Sobel gradient magnitude, scaled so a hard black to white edge
+// adds about 255*strength. It makes text and line art survive the tone
+// compression of the hidden layer
+func EdgeEnhance(img *image.Gray, strength float64) *image.Gray {
+	return edgeEnhance(context.Background(), img, strength)
+}
+
+// edgeEnhance implements EdgeEnhance, giving up early once ctx is done
+func edgeEnhance(ctx context.Context, img *image.Gray, strength float64) *image.Gray {
+	bounds := img.Bounds()
+	plane := make([]float32, bounds.Dx()*bounds.Dy())
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			plane[y*bounds.Dx()+x] = float32(row[x])
+		}
+	}
+
+	enhanced := edgePlane(ctx, plane, bounds.Dx(), bounds.Dy(), strength)
+	result := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for i, v := range enhanced {
+		result.Pix[i] = uint8(clamp(int(v+0.5), 0, 255))
+	}
+	return result
+}
+
+// edgeEnhance16 is edgeEnhance for 16-bit grayscale images
+func edgeEnhance16(ctx context.Context, img *image.Gray16, strength float64) *image.Gray16 {
+	return fromPlane16(edgePlane(ctx, toPlane16(img), img.Bounds().Dx(), img.Bounds().Dy(), strength), img.Bounds())
+}
+
+// edgePlane returns plane + strength*|sobel(plane)|/4 for a width x height
+// plane, repeating the border pixels at the edges
+func edgePlane(ctx context.Context, plane []float32, width, height int, strength float64) []float32 {
+	at := func(x, y int) float32 {
+		return plane[clamp(y, 0, height-1)*width+clamp(x, 0, width-1)]
+	}
+	result := make([]float32, len(plane))
+	parallelRowsContext(ctx, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+				gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+				// Sobel 核的权重和为 4，除以 4 让一条黑白硬边的幅值约等于 255
+				magnitude := float32(math.Sqrt(float64(gx*gx+gy*gy))) / 4
+				result[y*width+x] = plane[y*width+x] + float32(strength)*magnitude
+			}
+		}
+	})
+	return result
+}
+
+// toPlane16 copies a 16-bit grayscale image into a row-major float plane
+func toPlane16(img *image.Gray16) []float32 {
+	bounds := img.Bounds()
+	plane := make([]float32, bounds.Dx()*bounds.Dy())
+	for y := 0; y < bounds.Dy(); y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			plane[y*bounds.Dx()+x] = float32(get16(row, x))
+		}
+	}
+	return plane
+}
+
+// fromPlane16 rounds a plane made by toPlane16 back into a 16-bit grayscale image of bounds' size
+func fromPlane16(plane []float32, bounds image.Rectangle) *image.Gray16 {
+	result := image.NewGray16(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for i, v := range plane {
+		put16(result.Pix, i, uint16(clamp(int(v+0.5), 0, 65535)))
+	}
+	return result
+}
+
+// sharpenPlane returns plane + amount*(plane - blur(plane)) for a width x height
+// plane, see blurPlane
+func sharpenPlane(ctx context.Context, plane []float32, width, height int, radius, amount float64) []float32 {
+	result := blurPlane(ctx, plane, width, height, radius)
+	for i, blurred := range result {
+		result[i] = plane[i] + float32(amount)*(plane[i]-blurred)
+	}
+	return result
+}
+
+// blurPlane returns a width x height plane blurred by a separable Gaussian with
+// standard deviation radius, whose edges repeat the border pixels
+func blurPlane(ctx context.Context, plane []float32, width, height int, radius float64) []float32 {
+	kernel := gaussianKernel(radius)
+	half := len(kernel) / 2
+
+	// 先横向再纵向做两次一维模糊
+	horizontal := make([]float32, len(plane))
+	parallelRowsContext(ctx, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := plane[y*width : (y+1)*width]
+			for x := 0; x < width; x++ {
+				var sum float32
+				for k, weight := range kernel {
+					sum += weight * row[clamp(x+k-half, 0, width-1)]
+				}
+				horizontal[y*width+x] = sum
+			}
+		}
+	})
+
+	result := make([]float32, len(plane))
+	parallelRowsContext(ctx, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				var blurred float32
+				for k, weight := range kernel {
+					blurred += weight * horizontal[clamp(y+k-half, 0, height-1)*width+x]
+				}
+				result[y*width+x] = blurred
+			}
+		}
+	})
+	return result
+}
+
+// blurAlpha blurs the alpha channel of tank in place with a Gaussian of
+// standard deviation radius, leaving the colors alone, and returns tank.
+// A radius that is not positive changes nothing
+func blurAlpha(ctx context.Context, tank *image.NRGBA, radius float64) *image.NRGBA {
+	if radius <= 0 {
+		return tank
+	}
+	bounds := tank.Bounds()
+	plane := make([]float32, bounds.Dx()*bounds.Dy())
+	for y := 0; y < bounds.Dy(); y++ {
+		row := tank.Pix[tank.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			plane[y*bounds.Dx()+x] = float32(row[4*x+3])
+		}
+	}
+
+	blurred := blurPlane(ctx, plane, bounds.Dx(), bounds.Dy(), radius)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := tank.Pix[tank.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			row[4*x+3] = uint8(clamp(int(blurred[y*bounds.Dx()+x]+0.5), 0, 255))
+		}
+	}
+	return tank
+}
+
+// gaussianKernel returns a normalized 1D Gaussian with standard deviation sigma,
+// cut off at three sigma. A sigma that is not positive gives the identity kernel
+func gaussianKernel(sigma float64) []float32 {
+	if sigma <= 0 {
+		return []float32{1}
+	}
+	half := int(math.Ceil(3 * sigma))
+	kernel := make([]float32, 2*half+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - half)
+		w := math.Exp(-d * d / (2 * sigma * sigma))
+		kernel[i] = float32(w)
+		sum += w
+	}
+	for i := range kernel {
+		kernel[i] /= float32(sum)
+	}
+	return kernel
+}
@@ -0,0 +1,72 @@
+package miragetank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+)
+
+// minPairDifference is the smallest PairDifference for which the tank effect
+// is expected to work; below it the hidden image shows on any background
+const minPairDifference = 0.1
+
+// pairPreviewSize is the longer side of the previews checkPair compares. A mean
+// difference needs no detail, so the check costs next to nothing beside a render
+const pairPreviewSize = 64
+
+// errTooSimilar is returned by Render with StrictPair when the sources are too alike
+var errTooSimilar = errors.New("cover and hidden image are too similar to hide well")
+
+// PairDifference returns the mean absolute difference of two grayscale images
+// over their overlap, from 0 for identical images to 1 for black against white
+func PairDifference(grayA, grayB *image.Gray) float64 {
+	boundsA, boundsB := grayA.Bounds(), grayB.Bounds()
+	size := overlap(boundsA, boundsB)
+	if size.Empty() {
+		return 0
+	}
+
+	var sum int
+	for y := 0; y < size.Dy(); y++ {
+		rowA := grayA.Pix[grayA.PixOffset(boundsA.Min.X, boundsA.Min.Y+y):]
+		rowB := grayB.Pix[grayB.PixOffset(boundsB.Min.X, boundsB.Min.Y+y):]
+		for x := 0; x < size.Dx(); x++ {
+			d := int(rowA[x]) - int(rowB[x])
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+		}
+	}
+	return float64(sum) / float64(255*size.Dx()*size.Dy())
+}
+
+// checkPair compares small previews of the sources cover and hidden before
+// rendering. A pair whose PairDifference is below minPairDifference is logged
+// as a warning, or rejected with errTooSimilar when m.StrictPair is set
+func (m *MirageTank) checkPair(ctx context.Context, cover, hidden image.Image) error {
+	if m.pairChecked {
+		return nil
+	}
+	bounds := cover.Bounds()
+	width, height := pairPreviewSize, pairPreviewSize
+	if bounds.Dx() >= bounds.Dy() {
+		height = clamp(pairPreviewSize*bounds.Dy()/bounds.Dx(), 1, pairPreviewSize)
+	} else {
+		width = clamp(pairPreviewSize*bounds.Dx()/bounds.Dy(), 1, pairPreviewSize)
+	}
+	previewA := desaturateMethod(ctx, resize(cover, width, height, draw.ApproxBiLinear), m.GrayMethod)
+	previewB := desaturateMethod(ctx, resize(hidden, width, height, draw.ApproxBiLinear), m.GrayMethod)
+	d := PairDifference(previewA, previewB)
+	if d >= minPairDifference {
+		return nil
+	}
+	if m.StrictPair {
+		return fmt.Errorf("%w: mean difference %.3f, want at least %g", errTooSimilar, d, minPairDifference)
+	}
+	logger.Warn("cover and hidden image are very similar, the hidden image may show on any background",
+		"difference", d, "want", minPairDifference)
+	return nil
+}
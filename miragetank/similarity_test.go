@@ -0,0 +1,31 @@
+package miragetank
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// TestCheckPairDefaults checks that a near-identical pair only logs a warning
+// by default and fails the render with StrictPair
+func TestCheckPairDefaults(t *testing.T) {
+	var log bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&log, nil)))
+	defer SetLogger(nil)
+
+	cover := decodeNRGBA(t, "testdata/cover.png")
+	if _, err := NewMirageTank().Render(cover, cover); err != nil {
+		t.Fatalf("default render failed: %v", err)
+	}
+	if !strings.Contains(log.String(), "very similar") {
+		t.Errorf("default render logged %q, want a similarity warning", log.String())
+	}
+
+	m := NewMirageTank()
+	m.StrictPair = true
+	if _, err := m.Render(cover, cover); !errors.Is(err, errTooSimilar) {
+		t.Errorf("StrictPair render returned %v, want errTooSimilar", err)
+	}
+}
@@ -0,0 +1,52 @@
+package miragetank
+
+import (
+	"math"
+	"sync"
+)
+
+// The 16-bit sRGB transfer curves used by LinearLuminance, built on first use
+// by loadSRGBTables
+var (
+	srgbOnce sync.Once
+	// toLinear16 maps a 16-bit sRGB value to 16-bit linear light
+	toLinear16 [65536]uint16
+	// toSRGB16 maps 16-bit linear light back to a 16-bit sRGB value
+	toSRGB16 [65536]uint16
+)
+
+// loadSRGBTables fills toLinear16 and toSRGB16 once
+func loadSRGBTables() {
+	srgbOnce.Do(func() {
+		for i := range toLinear16 {
+			v := float64(i) / 65535
+			toLinear16[i] = uint16(srgbToLinear(v)*65535 + 0.5)
+			toSRGB16[i] = uint16(linearToSRGB(v)*65535 + 0.5)
+		}
+	})
+}
+
+// srgbToLinear decodes an sRGB value from 0 to 1 into linear light
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB encodes linear light from 0 to 1 as an sRGB value
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// linearLuminance16 returns the sRGB-encoded gray of the 16-bit sRGB color r, g, b,
+// weighting the channels in linear light by the Rec. 709 luminance coefficients
+func linearLuminance16(r, g, b uint32) uint16 {
+	loadSRGBTables()
+	// 先解码到线性光再按亮度系数加权，最后重新编码为 sRGB
+	y := (2126*uint32(toLinear16[r]) + 7152*uint32(toLinear16[g]) + 722*uint32(toLinear16[b]) + 5000) / 10000
+	return toSRGB16[y]
+}
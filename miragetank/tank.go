@@ -0,0 +1,524 @@
+package miragetank
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ResizeMode controls how the two source images are fitted onto a common canvas
+type ResizeMode int
+
+const (
+	// Stretch scales both images to cover's dimensions, distorting hidden when the aspect ratios differ
+	Stretch ResizeMode = iota
+	// Letterbox fits both images undistorted inside a canvas as wide and as tall as the larger of the two
+	Letterbox
+	// Fit keeps cover's dimensions but fits both images undistorted inside them,
+	// filling the uncovered area with MirageTank.Pad
+	Fit
+)
+
+// Format selects the encoder used for the finished tank
+type Format int
+
+const (
+	// PNG encodes the tank as a PNG file
+	PNG Format = iota
+	// WebP encodes the tank as a lossless WebP file
+	WebP
+	// FlattenedJPEG draws the tank over MirageTank.Background and encodes the
+	// result as a JPEG. This discards the hidden image, so FormatFor never picks it
+	FlattenedJPEG
+)
+
+// Dither selects which channels of the mask are dithered when rounded to 8 bits
+type Dither int
+
+const (
+	// NoDither rounds every channel to the nearest 8-bit value
+	NoDither Dither = iota
+	// DitherAlpha applies an ordered dither to the alpha channel only
+	DitherAlpha
+	// DitherAll applies an ordered dither to the alpha and the gray channel
+	DitherAll
+)
+
+// FormatFor picks the Format matching the extension of name, defaulting to PNG
+func FormatFor(name string) Format {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".webp":
+		return WebP
+	default:
+		return PNG
+	}
+}
+
+// Default lightness ratios applied to the cover and hidden images
+const (
+	DefaultForegroundRatio = 0.5
+	DefaultBackgroundRatio = -0.5
+)
+
+// GrayBlend combines two grayscale images into one, like LinearDodgeBlend
+type GrayBlend func(imgX, imgY *image.Gray) *image.Gray
+
+// MirageTank holds the settings used to render tanks, so one configuration
+// can be reused across many image pairs
+type MirageTank struct {
+	// Shrink scales the output relative to the source size
+	Shrink float64
+	// MaxDim, when positive, replaces Shrink with the factor that makes the
+	// longer side of the output at most MaxDim pixels; it never upscales
+	MaxDim int
+	// ForegroundRatio lightens the white-background (cover) image before blending
+	ForegroundRatio float64
+	// BackgroundRatio darkens the black-background (hidden) image before blending
+	BackgroundRatio float64
+	// GrayMethod is how both images are desaturated; the zero value is Lightness
+	GrayMethod GrayMethod
+	// Gamma is applied to both layers before blending and undone afterwards;
+	// 0 or 1 disables it
+	Gamma float64
+	// Sharpen is the UnsharpMask amount applied to both resized layers before
+	// blending, restoring detail such as small text that downscaling softens;
+	// 0 disables it
+	Sharpen float64
+	// SharpenRadius is the UnsharpMask radius in pixels; 0 means 1
+	SharpenRadius float64
+	// AutoContrast stretches the hidden layer's histogram to the full 0-255
+	// range before BackgroundRatio is applied, see the AutoContrast function.
+	// It makes low-contrast sources such as scanned documents easier to read
+	AutoContrast bool
+	// EdgeEnhance is the EdgeEnhance strength applied to the hidden layer after
+	// AutoContrast, keeping text and line art legible on black; 0 disables it
+	EdgeEnhance float64
+	// Posterize reduces both layers to this many gray levels before the ratios
+	// are applied, see the Posterize function, for a stylized tank; 0 or 1
+	// keeps every level
+	Posterize int
+	// ClipLowPct and ClipHighPct are the percentages of the darkest and
+	// brightest hidden pixels that AutoContrast ignores
+	ClipLowPct, ClipHighPct float64
+	// HighPrecision keeps every intermediate layer in 16-bit image.Gray16 and
+	// rounds to 8 bits only in the final mask, avoiding banding in smooth
+	// gradients. It needs the built-in blends, so Blend and Divide must be nil.
+	// RenderColor ignores it
+	HighPrecision bool
+	// Dither breaks up the contour lines that rounding leaves in smooth
+	// gradients, e.g. of a sky, with an 8x8 ordered dither. Any value but
+	// NoDither renders like HighPrecision, so it has the same restrictions
+	Dither Dither
+	// ExactColor makes RenderColor solve each pixel's color and alpha directly
+	// instead of running the gray blends per channel, see solveColor: the cover
+	// shows exactly on white and the hidden image as closely as one alpha
+	// allows on black. Blend, Divide and DivideReduction do not apply
+	ExactColor bool
+	// RatioMask, when set, scales ForegroundRatio and BackgroundRatio per pixel
+	// by its gray value: where it is white the full ratios apply, where black
+	// none, e.g. to hide the hidden image harder on a face. It is stretched to
+	// the canvas; nil applies the ratios everywhere
+	RatioMask image.Image
+	// Blend combines the inverted cover with the hidden layer into the alpha
+	// channel; nil means LinearDodgeBlend
+	Blend GrayBlend
+	// Divide recovers the gray channel from Blend's result and the hidden
+	// layer; nil means DivideBlend
+	Divide GrayBlend
+	// DivideReduction weakens the divide step from 0 (full strength, the
+	// classic tank) to 1 (the gray channel is just Blend's result). Values in
+	// between tame pairs whose hidden image blows out
+	DivideReduction float64
+	// Snap rounds the canvas width and height down to multiples of Snap, e.g.
+	// 2 or 16 for video encoders; 0 or 1 keeps the size Shrink gives
+	Snap int
+	// Resize decides how differently sized sources share one canvas
+	Resize ResizeMode
+	// Pad is the gray value around images placed by the Fit mode. It becomes
+	// part of both layers, so it shows up in the finished tank
+	Pad uint8
+	// Interpolator scales the sources, e.g. draw.NearestNeighbor for pixel art
+	// or draw.ApproxBiLinear for speed; nil means draw.CatmullRom.
+	// draw.BiLinear never overshoots and is the safer choice for hard-edged sources
+	Interpolator draw.Interpolator
+	// ClampOvershoot clamps resized pixels to each source's own value range,
+	// removing the halos CatmullRom leaves around high-contrast edges
+	ClampOvershoot bool
+	// Format is the encoder used by Encode
+	Format Format
+	// Background is the color FlattenedJPEG draws the tank over; nil means white
+	Background color.Color
+	// Quality is the FlattenedJPEG quality from 1 to 100; 0 means jpeg.DefaultQuality
+	Quality int
+	// Comment is written into PNG output as a text chunk, e.g. "Generated by
+	// mirage-tank". The empty default writes no metadata at all
+	Comment string
+	// Compression trades PNG encoding speed for file size; the zero value is
+	// png.DefaultCompression, png.BestSpeed suits large batches
+	Compression png.CompressionLevel
+	// AlphaBlur is the standard deviation in pixels of a Gaussian blur applied
+	// to the finished tank's alpha channel only, softening jagged alpha edges
+	// around line art. It trades the exact look on white and black for smoother
+	// edges; 0 keeps the output pixel exact
+	AlphaBlur float64
+	// MinAlpha raises every alpha below it to MinAlpha, darkening the color so
+	// the tank looks the same on white. Viewers that show fully transparent
+	// pixels as a checkerboard then keep the illusion, at the cost of the
+	// hidden image getting slightly brighter on black; 0 changes nothing
+	MinAlpha uint8
+	// Premultiplied makes Render and RenderColor return a premultiplied
+	// *image.RGBA instead of the straight-alpha *image.NRGBA, for libraries
+	// that assume RGBA. PNG and WebP store straight alpha, so encoding converts
+	// it back and loses precision where alpha is small; keep it off for files
+	Premultiplied bool
+	// StrictPair makes Render fail when cover and hidden are too similar for the
+	// effect to work, see PairDifference, instead of only logging a warning.
+	// The check compares small previews of the sources, so it is cheap next to
+	// the render
+	StrictPair bool
+	// DebugDir, when set, makes Render write every intermediate layer of the
+	// grayscale pipeline, from the resized sources to the finished tank, into
+	// this existing directory as numbered PNGs, to find the stage a bad tank
+	// goes wrong in. Failed writes are only logged
+	DebugDir string
+	// Pipeline replaces the stages Render runs on the fitted sources, e.g. to
+	// add a blur in front of the blend; nil means DefaultPipeline. The color,
+	// tiled and high-precision renders do not use it
+	Pipeline Pipeline
+	// Progress, when non-nil, is called with the finished fraction of the work
+	// as each stage of the Pipeline completes, reaching 1 with the last one.
+	// Entry points that also encode the tank, such as Build or RenderBytes,
+	// count Encode as one more stage and only reach 1 once it has written the tank
+	Progress func(fraction float64)
+	// OnProgress, when non-nil, is called whenever Progress would be, with the
+	// name of the stage that just completed and the finished share in percent,
+	// e.g. to drive a progress bar. The names are the Stage names of the
+	// Pipeline, StageEncode, StageFrame and StageStrip for the frames of
+	// RenderFrames and the strips of RenderTiled, and StageFit for the sizes
+	// FitBytes tries
+	OnProgress func(stage string, pct float64)
+
+	// pairChecked skips checkPair for renders whose sources were already checked
+	pairChecked bool
+}
+
+// Names OnProgress reports besides DefaultPipeline's stages
+const (
+	StageEncode = "encode"
+	StageFrame  = "frame"
+	StageStrip  = "strip"
+	StageFit    = "fit"
+)
+
+// progress reports that stage, number done of the total steps of a render, has
+// completed, so the last stage reports 1
+func (m *MirageTank) progress(stage string, done, total int) {
+	m.report(stage, float64(done)/float64(total))
+}
+
+// progressDefault is progress for the renders that do not run a Pipeline but
+// the same steps as DefaultPipeline, reporting stage at its place in there
+func (m *MirageTank) progressDefault(stage string) {
+	m.progress(stage, defaultPipeline.index(stage)+1, len(defaultPipeline))
+}
+
+// divideStrength returns the share of the divide step kept by DivideReduction, from 0 to 1
+func (m *MirageTank) divideStrength() float64 {
+	return math.Max(0, math.Min(1, 1-m.DivideReduction))
+}
+
+// scaled returns a copy of m whose progress hooks report the fractions of its
+// work as the span from lo to hi of m's, e.g. for one of several outputs
+func (m *MirageTank) scaled(lo, hi float64) *MirageTank {
+	s := *m
+	if m.Progress != nil {
+		s.Progress = func(fraction float64) { m.Progress(lo + (hi-lo)*fraction) }
+	}
+	if m.OnProgress != nil {
+		s.OnProgress = func(stage string, pct float64) { m.OnProgress(stage, 100*lo+(hi-lo)*pct) }
+	}
+	return &s
+}
+
+// beforeEncode returns m scaled for a render that Encode follows: with n
+// stages the render fills the first n/(n+1) of the work and Encode the rest
+func (m *MirageTank) beforeEncode() *MirageTank {
+	n := len(defaultPipeline)
+	if m.Pipeline != nil {
+		n = len(m.Pipeline)
+	}
+	return m.scaled(0, float64(n)/float64(n+1))
+}
+
+// report passes the finished fraction of the work to Progress and OnProgress,
+// naming stage as the one that just completed
+func (m *MirageTank) report(stage string, fraction float64) {
+	if m.Progress != nil {
+		m.Progress(fraction)
+	}
+	if m.OnProgress != nil {
+		m.OnProgress(stage, 100*fraction)
+	}
+}
+
+// NewMirageTank returns a MirageTank with the settings Build has always used
+func NewMirageTank() *MirageTank {
+	return &MirageTank{
+		Shrink:          1,
+		ForegroundRatio: DefaultForegroundRatio,
+		BackgroundRatio: DefaultBackgroundRatio,
+		Gamma:           1,
+		Resize:          Stretch,
+		Interpolator:    draw.CatmullRom,
+		Format:          PNG,
+	}
+}
+
+// Render runs the resize/desaturate/blend/mask pipeline on two decoded images.
+// cover is shown on a white background and hidden on a black one
+func (m *MirageTank) Render(cover, hidden image.Image) (image.Image, error) {
+	return m.RenderContext(context.Background(), cover, hidden)
+}
+
+// RenderContext is Render that gives up with ctx.Err() soon after ctx is done.
+// The pixel loops check ctx every few rows; custom Blend and Divide functions
+// cannot be interrupted and only see the cancellation once they return
+func (m *MirageTank) RenderContext(ctx context.Context, cover, hidden image.Image) (image.Image, error) {
+	if err := checkSources(cover, hidden); err != nil {
+		return nil, err
+	}
+	if err := m.checkPair(ctx, cover, hidden); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	imgA, imgB := m.fit(cover, hidden)
+	logger.Debug("stage done", "stage", "resize", "size", imgA.Bounds().Size(), "took", time.Since(start))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tank, err := m.renderFitted(ctx, imgA, imgB)
+	if err != nil {
+		return nil, err
+	}
+	return m.colorModel(ctx, tank), nil
+}
+
+// colorModel returns tank, an *image.NRGBA, converted to *image.RGBA if m.Premultiplied is set
+func (m *MirageTank) colorModel(ctx context.Context, tank image.Image) image.Image {
+	if !m.Premultiplied {
+		return tank
+	}
+	return premultiply(ctx, tank.(*image.NRGBA))
+}
+
+// renderFitted runs the pipeline after the resize step on two images that already share one canvas
+func (m *MirageTank) renderFitted(ctx context.Context, imgA, imgB image.Image) (image.Image, error) {
+	if m.HighPrecision || m.Dither != NoDither {
+		return m.renderHighPrecision(ctx, imgA, imgB)
+	}
+	m.dump(debugResizedA, imgA)
+	m.dump(debugResizedB, imgB)
+
+	pipeline := m.Pipeline
+	if pipeline == nil {
+		pipeline = DefaultPipeline()
+	}
+	layers := &Layers{Cover: imgA, Hidden: imgB}
+	if err := pipeline.run(ctx, m, layers); err != nil {
+		return nil, err
+	}
+	return layers.Tank, nil
+}
+
+// finish runs the passes on the finished tank: blurring its alpha by m.AlphaBlur,
+// then raising it to m.MinAlpha
+func (m *MirageTank) finish(ctx context.Context, tank *image.NRGBA) *image.NRGBA {
+	return raiseAlpha(ctx, blurAlpha(ctx, tank, m.AlphaBlur), m.MinAlpha)
+}
+
+// ratioMask returns m.RatioMask stretched to bounds and desaturated, or nil if it is not set
+func (m *MirageTank) ratioMask(bounds image.Rectangle) *image.Gray {
+	if m.RatioMask == nil {
+		return nil
+	}
+	interp := m.Interpolator
+	if interp == nil {
+		interp = draw.CatmullRom
+	}
+	return Desaturate(resize(m.RatioMask, bounds.Dx(), bounds.Dy(), interp))
+}
+
+// sharpen applies the configured UnsharpMask to img, or returns it unchanged when m.Sharpen is 0
+func (m *MirageTank) sharpen(ctx context.Context, img *image.Gray) *image.Gray {
+	if m.Sharpen == 0 {
+		return img
+	}
+	return unsharpMask(ctx, img, m.sharpenRadius(), m.Sharpen)
+}
+
+// sharpenRadius returns m.SharpenRadius, defaulting to 1
+func (m *MirageTank) sharpenRadius() float64 {
+	if m.SharpenRadius == 0 {
+		return 1
+	}
+	return m.SharpenRadius
+}
+
+// checkSources rejects source images without any pixels, which cannot be resized
+func checkSources(cover, hidden image.Image) error {
+	if cover.Bounds().Empty() {
+		return fmt.Errorf("cover has no pixels: %v", cover.Bounds())
+	}
+	if hidden.Bounds().Empty() {
+		return fmt.Errorf("hidden image has no pixels: %v", hidden.Bounds())
+	}
+	return nil
+}
+
+// blends returns m.Blend and m.Divide, using the cancellable built-in
+// LinearDodgeBlend and DivideBlend for nil fields
+func (m *MirageTank) blends(ctx context.Context) (blend, divide GrayBlend) {
+	blend, divide = m.Blend, m.Divide
+	if blend == nil {
+		blend = func(imgX, imgY *image.Gray) *image.Gray { return linearDodgeBlend(ctx, imgX, imgY) }
+	}
+	if divide == nil {
+		divide = func(imgX, imgY *image.Gray) *image.Gray { return divideBlend(ctx, imgX, imgY) }
+	}
+	return blend, divide
+}
+
+// fit resizes the cover and hidden images onto one canvas according to m.Resize and m.Shrink
+func (m *MirageTank) fit(imgA, imgB image.Image) (image.Image, image.Image) {
+	interp := m.Interpolator
+	if interp == nil {
+		interp = draw.CatmullRom
+	}
+	if m.ClampOvershoot {
+		interp = clampedInterpolator{interp}
+	}
+
+	width, height := m.canvas(imgA.Bounds(), imgB.Bounds())
+	padA, padB, fitted := m.padding()
+	if fitted {
+		return resizeFit(imgA, width, height, padA, interp), resizeFit(imgB, width, height, padB, interp)
+	}
+	return resize(imgA, width, height, interp), resize(imgB, width, height, interp)
+}
+
+// padding returns the gray values around the fitted cover and hidden images, and whether
+// m.Resize fits the images undistorted at all instead of stretching them
+func (m *MirageTank) padding() (padA, padB uint8, fitted bool) {
+	switch m.Resize {
+	case Letterbox:
+		// 表图用白色、里图用黑色填充空白区域，合成后这部分是完全透明的
+		return 255, 0, true
+	case Fit:
+		return m.Pad, m.Pad, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// canvas returns the output size for sources with the given bounds: the size
+// m.Resize starts from, scaled by m.Shrink or fitted to m.MaxDim
+func (m *MirageTank) canvas(boundsA, boundsB image.Rectangle) (width, height int) {
+	width, height = boundsA.Dx(), boundsA.Dy()
+	if m.Resize == Letterbox {
+		if boundsB.Dx() > width {
+			width = boundsB.Dx()
+		}
+		if boundsB.Dy() > height {
+			height = boundsB.Dy()
+		}
+	}
+
+	shrink := m.Shrink
+	if m.MaxDim > 0 {
+		// 让长边刚好等于 MaxDim，但不放大
+		longest := width
+		if height > longest {
+			longest = height
+		}
+		shrink = 1
+		if longest > m.MaxDim {
+			shrink = float64(m.MaxDim) / float64(longest)
+		}
+	}
+	// 缩放系数很小时宽高会被截断为 0，至少保留 1 像素
+	width, height = int(float64(width)*shrink), int(float64(height)*shrink)
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	if m.Snap > 1 {
+		width, height = snapDown(width, m.Snap), snapDown(height, m.Snap)
+	}
+	return width, height
+}
+
+// snapDown rounds v down to a multiple of n, but never below n
+func snapDown(v, n int) int {
+	if v < n {
+		return n
+	}
+	return v / n * n
+}
+
+// EncodeContext is Encode that gives up with ctx.Err() soon after ctx is done,
+// failing the encoder at its next write
+func (m *MirageTank) EncodeContext(ctx context.Context, w io.Writer, img image.Image) error {
+	return m.Encode(ctxWriter{ctx: ctx, w: w}, img)
+}
+
+// ctxWriter fails every write once ctx is done, so an encoder writing to it stops early
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// Encode writes a rendered tank to w in m.Format; failures wrap ErrEncode
+func (m *MirageTank) Encode(w io.Writer, img image.Image) error {
+	start := time.Now()
+	var err error
+	switch m.Format {
+	case WebP:
+		err = EncodeWebP(w, img)
+	case FlattenedJPEG:
+		bg := m.Background
+		if bg == nil {
+			bg = color.White
+		}
+		quality := m.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(w, CompositeOver(img, bg), &jpeg.Options{Quality: quality})
+	default:
+		err = encodePNG(w, img, m.Comment, m.Compression)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrEncode, err)
+	}
+	logger.Debug("stage done", "stage", StageEncode, "took", time.Since(start))
+	m.report(StageEncode, 1)
+	return nil
+}
@@ -0,0 +1,273 @@
+package miragetank
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+// DefaultTileRows is the strip height RenderTiled uses when rows is 0
+const DefaultTileRows = 256
+
+// errTiledOption is returned when RenderTiled meets a setting that needs the whole image at once
+var errTiledOption = errors.New("tiled rendering does not support Sharpen, AutoContrast, EdgeEnhance, ClampOvershoot, RatioMask, AlphaBlur, DebugDir or Pipeline")
+
+// BuildTiled creates the 'mirage tank' image like Build with the default ratios,
+// but renders and writes it in strips of rows output rows, see RenderTiled.
+// The output is always a PNG
+func BuildTiled(cover, hidden, targetName string, shrink float64, rows int) error {
+	m := NewMirageTank()
+	m.Shrink = shrink
+	return m.BuildTiled(cover, hidden, targetName, rows)
+}
+
+// BuildTiled decodes cover and hidden, which may be files, http(s) URLs or
+// Stdio, and writes their tank with m's settings to targetName in strips of
+// rows output rows, see RenderTiled. m.Format must be PNG
+func (m *MirageTank) BuildTiled(cover, hidden, targetName string, rows int) error {
+	logger.Debug("start processing", "cover", cover, "hidden", hidden, "output", targetName)
+	imgAFile, err := openSource(context.Background(), cover)
+	if err != nil {
+		return err
+	}
+	defer imgAFile.Close()
+
+	imgBFile, err := openSource(context.Background(), hidden)
+	if err != nil {
+		return err
+	}
+	defer imgBFile.Close()
+
+	imgA, imgB, err := DecodePair(imgAFile, imgBFile)
+	if err != nil {
+		return err
+	}
+
+	outputFile, err := createOutput(targetName)
+	if err != nil {
+		return err
+	}
+	if err := m.RenderTiled(context.Background(), imgA, imgB, outputFile, rows); err != nil {
+		outputFile.Abort()
+		return fmt.Errorf("encode %s: %w", targetName, err)
+	}
+	if err := outputFile.Close(); err != nil {
+		return err
+	}
+
+	logger.Debug("finished", "output", targetName)
+	return nil
+}
+
+// RenderTiled renders the tank of cover and hidden like Render and streams it to w as
+// a PNG, one horizontal strip of rows output rows at a time. Only the decoded
+// sources and a single strip of intermediate images are in memory at once, so
+// the peak memory no longer grows with the output size. The resize samples the
+// sources with Interpolator's Transform, so pixels may differ from Render by a
+// level here and there. m.Progress and m.OnProgress, if set, are called after
+// every strip
+func (m *MirageTank) RenderTiled(ctx context.Context, cover, hidden image.Image, w io.Writer, rows int) error {
+	return m.renderTiled(ctx, cover, hidden, w, rows, (*MirageTank).renderFitted)
+}
+
+// RenderColorTiled is RenderTiled for RenderColor
+func (m *MirageTank) RenderColorTiled(ctx context.Context, cover, hidden image.Image, w io.Writer, rows int) error {
+	return m.renderTiled(ctx, cover, hidden, w, rows, (*MirageTank).renderColorFitted)
+}
+
+// stripFunc runs the pipeline after the resize step on one strip
+type stripFunc func(m *MirageTank, ctx context.Context, imgA, imgB image.Image) (image.Image, error)
+
+// renderTiled implements RenderTiled and RenderColorTiled, running render on every strip
+func (m *MirageTank) renderTiled(ctx context.Context, cover, hidden image.Image, w io.Writer, rows int, render stripFunc) error {
+	if m.Format != PNG {
+		return errors.New("tiled rendering only writes PNG")
+	}
+	if m.Sharpen != 0 || m.AutoContrast || m.EdgeEnhance != 0 || m.ClampOvershoot || m.RatioMask != nil || m.AlphaBlur != 0 || m.DebugDir != "" || m.Pipeline != nil {
+		return errTiledOption
+	}
+	if err := checkSources(cover, hidden); err != nil {
+		return err
+	}
+	if err := m.checkPair(ctx, cover, hidden); err != nil {
+		return err
+	}
+	if rows <= 0 {
+		rows = DefaultTileRows
+	}
+
+	interp := m.Interpolator
+	if interp == nil {
+		interp = draw.CatmullRom
+	}
+	width, height := m.canvas(cover.Bounds(), hidden.Bounds())
+	padA, padB, fitted := m.padding()
+
+	out, err := newPNGStream(w, width, height, m.Comment, m.Compression)
+	if err != nil {
+		return err
+	}
+
+	// 每个条带单独汇报进度没有意义，改为按完成的条带数汇报
+	stripTank := *m
+	stripTank.Progress, stripTank.OnProgress = nil, nil
+	for y0 := 0; y0 < height; y0 += rows {
+		y1 := y0 + rows
+		if y1 > height {
+			y1 = height
+		}
+		stripA := resizeStrip(cover, width, height, y0, y1, padA, fitted, interp)
+		stripB := resizeStrip(hidden, width, height, y0, y1, padB, fitted, interp)
+		tank, err := render(&stripTank, ctx, stripA, stripB)
+		if err != nil {
+			return err
+		}
+		if err := out.writeRows(tank.(*image.NRGBA)); err != nil {
+			return err
+		}
+		m.report(StageStrip, float64(y1)/float64(height))
+	}
+	return out.close()
+}
+
+// resizeStrip returns the rows [y0, y1) of img resized onto a width x height
+// canvas, like resize or, if fitted, resizeFit with pad. It only samples the
+// source rows that can affect the strip
+func resizeStrip(img image.Image, width, height, y0, y1 int, pad uint8, fitted bool, interp draw.Interpolator) *image.RGBA {
+	strip := image.NewRGBA(image.Rect(0, y0, width, y1))
+	dr := image.Rect(0, 0, width, height)
+	if fitted {
+		draw.Draw(strip, strip.Bounds(), image.NewUniform(color.Gray{Y: pad}), image.Point{}, draw.Src)
+		dr = fitRect(img.Bounds(), width, height)
+	}
+
+	sr := img.Bounds()
+	sx := float64(dr.Dx()) / float64(sr.Dx())
+	sy := float64(dr.Dy()) / float64(sr.Dy())
+	s2d := f64.Aff3{
+		sx, 0, float64(dr.Min.X) - float64(sr.Min.X)*sx,
+		0, sy, float64(dr.Min.Y) - float64(sr.Min.Y)*sy,
+	}
+
+	// 只取条带对应的源图行，再加上插值核覆盖的余量
+	support := 2.0
+	if k, ok := interp.(*draw.Kernel); ok {
+		support = k.Support
+	}
+	margin := int(math.Ceil(support*math.Max(1, 1/sy))) + 2
+	band := image.Rect(sr.Min.X,
+		sr.Min.Y+int(math.Floor(float64(y0-dr.Min.Y)/sy))-margin,
+		sr.Max.X,
+		sr.Min.Y+int(math.Ceil(float64(y1-dr.Min.Y)/sy))+margin,
+	).Intersect(sr)
+	interp.Transform(strip, s2d, img, band, draw.Over, nil)
+	return strip
+}
+
+// pngStream writes an 8-bit RGBA PNG row by row, compressing as it goes
+type pngStream struct {
+	w     io.Writer
+	buf   *bufio.Writer
+	zw    *zlib.Writer
+	row   []byte
+	width int
+}
+
+// newPNGStream writes the PNG header for a width x height image, with comment
+// in a text chunk unless it is empty, and returns the stream for its rows,
+// compressed at level like png.Encoder would
+func newPNGStream(w io.Writer, width, height int, comment string, level png.CompressionLevel) (*pngStream, error) {
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return nil, err
+	}
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8], ihdr[9] = 8, 6 // 8 位 RGBA，非预乘
+	if err := writeChunk(w, "IHDR", ihdr[:]); err != nil {
+		return nil, err
+	}
+	if comment != "" {
+		if err := writeTextChunk(w, "Comment", comment); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &pngStream{w: w, row: make([]byte, 1+4*width), width: width}
+	s.buf = bufio.NewWriterSize(idatWriter{w}, 1<<16)
+	// zlibLevel 只返回合法的级别，NewWriterLevel 不会出错
+	s.zw, _ = zlib.NewWriterLevel(s.buf, zlibLevel(level))
+	return s, nil
+}
+
+// zlibLevel maps a png.CompressionLevel to the zlib level png.Encoder uses for it
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	default:
+		return zlib.DefaultCompression
+	}
+}
+
+// writeRows appends every row of img, which must be as wide as the stream
+func (s *pngStream) writeRows(img *image.NRGBA) error {
+	bounds := img.Bounds()
+	if bounds.Dx() != s.width {
+		return fmt.Errorf("strip is %d pixels wide, want %d", bounds.Dx(), s.width)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := img.Pix[img.PixOffset(bounds.Min.X, y):][:4*s.width]
+		// Sub 过滤：每个字节减去左边像素的同一通道，不依赖上一行
+		s.row[0] = 1
+		for i, v := range pix {
+			if i < 4 {
+				s.row[1+i] = v
+			} else {
+				s.row[1+i] = v - pix[i-4]
+			}
+		}
+		if _, err := s.zw.Write(s.row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close flushes the compressed rows and writes the final IEND chunk
+func (s *pngStream) close() error {
+	if err := s.zw.Close(); err != nil {
+		return err
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return writeChunk(s.w, "IEND", nil)
+}
+
+// idatWriter wraps every write in its own IDAT chunk
+type idatWriter struct {
+	w io.Writer
+}
+
+// Write writes p as one IDAT chunk
+func (w idatWriter) Write(p []byte) (int, error) {
+	if err := writeChunk(w.w, "IDAT", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,44 @@
+package miragetank
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// TestRenderTiledDitherMatchesRender renders the testdata pair dithered in
+// strips of 7 rows, which do not line up with the 8x8 Bayer matrix, and checks
+// the result matches Render pixel for pixel
+func TestRenderTiledDitherMatchesRender(t *testing.T) {
+	cover, hidden := decodeNRGBA(t, "testdata/cover.png"), decodeNRGBA(t, "testdata/hidden.png")
+	m := NewMirageTank()
+	m.Dither = DitherAll
+
+	var buf bytes.Buffer
+	if err := m.RenderTiled(context.Background(), cover, hidden, &buf, 7); err != nil {
+		t.Fatal(err)
+	}
+	tiled, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole, err := m.Render(cover, hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := whole.(*image.NRGBA)
+	got, ok := tiled.(*image.NRGBA)
+	if !ok || got.Bounds() != want.Bounds() {
+		t.Fatalf("tiled tank is %T %v, want *image.NRGBA %v", tiled, tiled.Bounds(), want.Bounds())
+	}
+	for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+		for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+			if g, w := got.NRGBAAt(x, y), want.NRGBAAt(x, y); g != w {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package miragetank
+
+import (
+	"context"
+	"image"
+)
+
+// tuneRatios are the lightness ratio magnitudes TuneRatios tries for each side
+var tuneRatios = []float64{0.2, 0.3, 0.4, 0.5, 0.6, 0.7}
+
+// tunePreviewDim is the longest side of the previews TuneRatios scores
+const tunePreviewDim = 256
+
+// tuneMaxBleed is the share of pixels TuneRatios lets one image bleed into the other
+const tuneMaxBleed = 0.01
+
+// tuneTolerance is how far a composited pixel may stray before it counts as bleeding
+const tuneTolerance = 3
+
+// TuneRatios searches a grid of ForegroundRatio and BackgroundRatio pairs for
+// the one that keeps the most contrast while still separating the images.
+// Each pair is rendered on a small preview with m's other settings, and a pixel
+// bleeds where the tank over white or over black strays from the cover or hidden
+// image the ratios alone would give. Of the pairs where at most 1% of the pixels
+// bleed, the one squeezing the two ranges least wins; if none qualifies, the one
+// bleeding least
+func (m *MirageTank) TuneRatios(ctx context.Context, cover, hidden image.Image) (foreground, background float64, err error) {
+	if err := checkSources(cover, hidden); err != nil {
+		return 0, 0, err
+	}
+
+	// 锐化和 alpha 模糊只改变细节，不影响两张图能否分开，预览里关掉它们以免误判为串色
+	preview := *m
+	preview.MaxDim = tunePreviewDim
+	preview.Sharpen = 0
+	preview.AlphaBlur = 0
+	preview.Progress, preview.OnProgress = nil, nil
+	preview.DebugDir = ""
+	fittedA, fittedB := preview.fit(cover, hidden)
+	grayA := desaturateMethod(ctx, fittedA, m.GrayMethod)
+	grayB := desaturateMethod(ctx, fittedB, m.GrayMethod)
+	if m.AutoContrast {
+		grayB = autoContrast(ctx, grayB, m.ClipLowPct, m.ClipHighPct)
+	}
+	if m.Posterize >= 2 {
+		grayA, grayB = posterize(ctx, grayA, m.Posterize), posterize(ctx, grayB, m.Posterize)
+	}
+	mask := preview.ratioMask(grayA.Bounds())
+	if mask != nil {
+		// 预览尺寸的遮罩只缩放一次，避免每次渲染都重新缩放原图
+		preview.RatioMask = mask
+	}
+
+	best := tuneCandidate{bleed: 2}
+	for _, fr := range tuneRatios {
+		for _, br := range tuneRatios {
+			preview.ForegroundRatio, preview.BackgroundRatio = fr, -br
+			tank, err := preview.renderFitted(ctx, fittedA, fittedB)
+			if err != nil {
+				return 0, 0, err
+			}
+			c := tuneCandidate{
+				foreground: fr,
+				background: -br,
+				bleed: bleedShare(ExtractCover(tank), adjustLightnessMasked(ctx, grayA, fr, mask),
+					ExtractHidden(tank), adjustLightnessMasked(ctx, grayB, -br, mask)),
+			}
+			if c.better(best) {
+				best = c
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	return best.foreground, best.background, nil
+}
+
+// RenderTuned runs TuneRatios on cover and hidden and renders their tank with
+// the ratios it picked and m's other settings, returning the tank together
+// with the ratios. m itself is not modified
+func (m *MirageTank) RenderTuned(ctx context.Context, cover, hidden image.Image) (tank image.Image, foreground, background float64, err error) {
+	foreground, background, err = m.TuneRatios(ctx, cover, hidden)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	tuned := *m
+	tuned.ForegroundRatio, tuned.BackgroundRatio = foreground, background
+	tank, err = tuned.RenderContext(ctx, cover, hidden)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return tank, foreground, background, nil
+}
+
+// tuneCandidate is one ratio pair scored by TuneRatios
+type tuneCandidate struct {
+	foreground, background float64
+	// bleed is the share of pixels where one image shows through the other
+	bleed float64
+}
+
+// better reports whether c should replace best in TuneRatios
+func (c tuneCandidate) better(best tuneCandidate) bool {
+	okC, okBest := c.bleed <= tuneMaxBleed, best.bleed <= tuneMaxBleed
+	if okC != okBest {
+		return okC
+	}
+	if !okC {
+		return c.bleed < best.bleed
+	}
+	// 都不串色时选对比度损失最小的，一样时选两边更均衡的
+	if c.squeeze() != best.squeeze() {
+		return c.squeeze() < best.squeeze()
+	}
+	return c.imbalance() < best.imbalance()
+}
+
+// squeeze is how much the pair compresses the two images' gray ranges in total
+func (c tuneCandidate) squeeze() float64 {
+	return c.foreground - c.background
+}
+
+// imbalance is how unevenly the pair splits the squeeze between the two images
+func (c tuneCandidate) imbalance() float64 {
+	d := c.foreground + c.background
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// bleedShare returns the share of pixels where gotCover strays from wantCover
+// or gotHidden from wantHidden by more than tuneTolerance
+func bleedShare(gotCover, wantCover, gotHidden, wantHidden *image.Gray) float64 {
+	bounds := overlap(gotCover.Bounds(), wantCover.Bounds())
+	if bounds.Empty() {
+		return 0
+	}
+	var bleeding int
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if grayOff(gotCover, wantCover, x, y) || grayOff(gotHidden, wantHidden, x, y) {
+				bleeding++
+			}
+		}
+	}
+	return float64(bleeding) / float64(bounds.Dx()*bounds.Dy())
+}
+
+// grayOff reports whether the pixels at x, y from the top-left of got and want
+// differ by more than tuneTolerance
+func grayOff(got, want *image.Gray, x, y int) bool {
+	g := got.Pix[got.PixOffset(got.Rect.Min.X+x, got.Rect.Min.Y+y)]
+	w := want.Pix[want.PixOffset(want.Rect.Min.X+x, want.Rect.Min.Y+y)]
+	d := int(g) - int(w)
+	return d > tuneTolerance || d < -tuneTolerance
+}
@@ -0,0 +1,31 @@
+package miragetank
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"testing"
+)
+
+// TestRenderTuned checks that RenderTuned returns the tank of the ratios it
+// reports and leaves the MirageTank's own ratios alone
+func TestRenderTuned(t *testing.T) {
+	cover, hidden := decodeNRGBA(t, "testdata/cover.png"), decodeNRGBA(t, "testdata/hidden.png")
+	m := NewMirageTank()
+	tank, foreground, background, err := m.RenderTuned(context.Background(), cover, hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ForegroundRatio != DefaultForegroundRatio || m.BackgroundRatio != DefaultBackgroundRatio {
+		t.Errorf("RenderTuned changed m's ratios to %v, %v", m.ForegroundRatio, m.BackgroundRatio)
+	}
+
+	m.ForegroundRatio, m.BackgroundRatio = foreground, background
+	want, err := m.Render(cover, hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tank.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+		t.Errorf("RenderTuned tank differs from rendering with ratios %v, %v", foreground, background)
+	}
+}
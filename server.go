@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/oigeek/mirage-tank-images/miragetank"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// server holds the settings of the HTTP server
+type server struct {
+	addr      string
+	staticDir string
+	// maxUpload caps the size of a /generate request body in bytes
+	maxUpload int64
+	// maxPixels caps the pixel count of each decoded source and of the output
+	maxPixels int
+	// drain is how long a shutdown waits for in-flight requests
+	drain time.Duration
+	// maxConcurrent caps how many /generate requests run at once; 0 means no limit
+	maxConcurrent int
+	// slots holds one token per running /generate request, see handler
+	slots chan struct{}
+}
+
+// serve runs the HTTP server, see handler, until SIGINT or SIGTERM arrives.
+// It then stops accepting connections and gives in-flight requests up to
+// s.drain to finish before closing them
+func (s *server) serve() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: s.addr, Handler: s.handler()}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	logger.Info("服务器已启动", "addr", s.addr, "static", s.staticDir)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	// 收到信号后不再接受新连接，等待正在生成的请求完成
+	logger.Info("正在关闭服务器", "drain", s.drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("drain timed out, closing remaining connections", "err", err)
+		srv.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// handler routes the server's requests: POST /generate builds tanks, GET /healthz
+// and /readyz answer health checks and everything else is served from staticDir
+func (s *server) handler() http.Handler {
+	if s.maxConcurrent > 0 && s.slots == nil {
+		s.slots = make(chan struct{}, s.maxConcurrent)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate", s.handleGenerate)
+	mux.HandleFunc("/healthz", handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.Handle("/", http.FileServer(http.Dir(s.staticDir)))
+	return mux
+}
+
+// handleHealth reports that the process is up and serving requests
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+// handleReady reports whether the server can do its work: every source format
+// decodes and the static directory exists. It never renders, so it stays fast
+// however busy /generate is
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := checkDecoders(); err != nil {
+		http.Error(w, "decoders: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if info, err := os.Stat(s.staticDir); err != nil || !info.IsDir() {
+		http.Error(w, "static directory unavailable: "+s.staticDir, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ready\n")
+}
+
+// decodersOnce and decodersErr cache the result of checkDecoders
+var (
+	decodersOnce sync.Once
+	decodersErr  error
+)
+
+// checkDecoders round-trips a 1x1 image through every supported source format
+// once, reporting the first one image.DecodeConfig does not recognize
+func checkDecoders() error {
+	decodersOnce.Do(func() {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		encoders := []struct {
+			format string
+			encode func(io.Writer, image.Image) error
+		}{
+			{"png", png.Encode},
+			{"jpeg", func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) }},
+			{"gif", func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) }},
+			{"webp", miragetank.EncodeWebP},
+			{"bmp", bmp.Encode},
+			{"tiff", func(w io.Writer, m image.Image) error { return tiff.Encode(w, m, nil) }},
+		}
+		for _, e := range encoders {
+			var buf bytes.Buffer
+			if err := e.encode(&buf, img); err != nil {
+				decodersErr = fmt.Errorf("encode %s probe: %w", e.format, err)
+				return
+			}
+			if _, format, err := image.DecodeConfig(&buf); err != nil || format != e.format {
+				decodersErr = fmt.Errorf("%s decoder not registered", e.format)
+				return
+			}
+		}
+	})
+	return decodersErr
+}
+
+// handleGenerate builds a tank from the multipart file fields cover and hidden
+// and responds with the PNG. The optional shrink field defaults to 1; with
+// preview=1 the response shows the tank on white and on black side by side
+// instead, see Compare
+func (s *server) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	defer recoverRender(w)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 并发数已满时直接拒绝，而不是排队占用更多内存
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes", s.maxUpload), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shrink := 1.0
+	if v := r.FormValue("shrink"); v != "" {
+		var err error
+		shrink, err = strconv.ParseFloat(v, 64)
+		// NaN 和任何数比较都是 false，要写成 !(shrink > 0) 才能拒绝
+		if err != nil || !(shrink > 0) || math.IsInf(shrink, 0) {
+			http.Error(w, "invalid shrink: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	cover, _, err := r.FormFile("cover")
+	if err != nil {
+		http.Error(w, "missing cover image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cover.Close()
+
+	hidden, _, err := r.FormFile("hidden")
+	if err != nil {
+		http.Error(w, "missing hidden image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer hidden.Close()
+
+	// 解码之前先读图片头，像素数超限的直接拒绝，避免分配巨大的缓冲区
+	for _, f := range []multipart.File{cover, hidden} {
+		if err := checkPixels(f, s.maxPixels, shrink); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errTooManyPixels) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	imgA, imgB, err := miragetank.DecodePair(cover, hidden)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m := miragetank.NewMirageTank()
+	m.Shrink = shrink
+	finalImage, err := m.RenderContext(r.Context(), imgA, imgB)
+	if err != nil {
+		logger.Error("render failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// preview=1 时返回白底和黑底效果的左右对比图，方便确认里图确实被隐藏了
+	if preview, _ := strconv.ParseBool(r.FormValue("preview")); preview {
+		finalImage = miragetank.Compare(finalImage)
+	}
+
+	// 先编码到内存，出错时还能返回错误状态码
+	var buf bytes.Buffer
+	if err := m.EncodeContext(r.Context(), &buf, finalImage); err != nil {
+		logger.Error("encode failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+// recoverRender turns a panic in the rest of a handler into a 500 response and
+// logs it with its stack, so one bad upload cannot take down the whole server.
+// Deferred first, it runs after every other deferred call of the handler
+func recoverRender(w http.ResponseWriter) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		// net/http 用它来中断响应，交给它自己处理
+		panic(v)
+	}
+	stack := debug.Stack()
+	if band, ok := v.(*miragetank.BandPanic); ok {
+		v, stack = band.Value, band.Stack
+	}
+	logger.Error("render panicked", "panic", v, "stack", string(stack))
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// errTooManyPixels is returned by checkPixels for images over the pixel limit
+var errTooManyPixels = errors.New("too many pixels")
+
+// checkPixels reads the header of the image in f and rejects it when the image,
+// or the output it would produce at shrink, has more than limit pixels.
+// f is rewound so it can be decoded afterwards
+func checkPixels(f io.ReadSeeker, limit int, shrink float64) error {
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("decode image header: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	pixels := float64(config.Width) * float64(config.Height)
+	if !(pixels <= float64(limit)) || !(pixels*shrink*shrink <= float64(limit)) {
+		return fmt.Errorf("%w: image of %dx%d at shrink %g exceeds %d pixels",
+			errTooManyPixels, config.Width, config.Height, shrink, limit)
+	}
+	return nil
+}